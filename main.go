@@ -1,19 +1,21 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/veertuinc/anka-prometheus-exporter/envflag"
 	"github.com/veertuinc/anka-prometheus-exporter/src/client"
+	"github.com/veertuinc/anka-prometheus-exporter/src/config"
+	"github.com/veertuinc/anka-prometheus-exporter/src/exporter"
+	"github.com/veertuinc/anka-prometheus-exporter/src/inventory"
 	"github.com/veertuinc/anka-prometheus-exporter/src/log"
 	"github.com/veertuinc/anka-prometheus-exporter/src/metrics"
-	"github.com/veertuinc/anka-prometheus-exporter/src/server"
-)
-
-const (
-	DEFAULT_INTERVAL_SECONDS = 15
 )
 
 var (
@@ -22,11 +24,32 @@ var (
 
 func main() {
 
+	var configFile string
+	var controllerName string
 	var controllerAddress string
 	var controllerUsername string
 	var controllerPassword string
 	var intervalSeconds int
+	var intervals config.Intervals
 	var disableOptimizeInterval bool
+	var enableProbe bool
+	var collectOnScrape bool
+	var collectMinAgeSeconds int
+	var stalePolicy string
+	var staleIntervals int
+	var shutdownGraceSeconds int
+	var stuckThresholds string
+	var stuckInstancesInfo bool
+	var nodeFlapThreshold int
+	var nodeFlapWindowSeconds int
+	var inventoryFile string
+	var stateFile string
+	var checkpointSeconds int
+	var clientConnectTimeoutSeconds int
+	var clientTLSHandshakeTimeoutSeconds int
+	var clientRequestTimeoutSeconds int
+	var clientMaxConnections int
+	var clientMaxConcurrentRequests int
 	var clientCaFilePath string
 	var clientCertPath string
 	var clientCertKeyPath string
@@ -44,12 +67,38 @@ func main() {
 	flag.StringVar(&webConfigFile, "web.config.file", "", "Path to configuration file that can enable server TLS or authentication. See: https://github.com/prometheus/exporter-toolkit/blob/master/docs/web-configuration.md")
 	envflag.StringVar(&webConfigFile, "WEB_CONFIG_FILE", "", "Path to configuration file that can enable server TLS or authentication. See: https://github.com/prometheus/exporter-toolkit/blob/master/docs/web-configuration.md")
 
-	flag.StringVar(&controllerAddress, "controller-address", "", "Controller address to monitor (url as arg) (required)")
+	flag.StringVar(&configFile, "config-file", "", "Path to a YAML file listing the Controllers to monitor (path as arg)")
+	flag.StringVar(&controllerName, "controller-name", "", "Name used for the controller label of the -controller-address Controller; defaults to its address (name as arg)")
+	flag.StringVar(&controllerAddress, "controller-address", "", "Controller address to monitor (url as arg) (required unless -config-file is used)")
 	flag.StringVar(&controllerUsername, "controller-username", "", "Controller basic auth username (username as arg)")
 	flag.StringVar(&controllerPassword, "controller-password", "", "Controller basic auth password (password as arg)")
-	flag.IntVar(&intervalSeconds, "interval", DEFAULT_INTERVAL_SECONDS, "Seconds to wait between data requests to controller (int as arg)")
+	flag.IntVar(&intervalSeconds, "interval", exporter.DEFAULT_INTERVAL_SECONDS, "Seconds to wait between data requests to controller (int as arg)")
+	flag.IntVar(&intervals.Status, "interval-status", 0, "Seconds to wait between status requests; defaults to -interval (int as arg)")
+	flag.IntVar(&intervals.Nodes, "interval-nodes", 0, "Seconds to wait between node requests; defaults to -interval (int as arg)")
+	flag.IntVar(&intervals.Groups, "interval-groups", 0, "Seconds to wait between group requests; defaults to -interval (int as arg)")
+	flag.IntVar(&intervals.Vms, "interval-vms", 0, "Seconds to wait between vm instance requests; defaults to -interval (int as arg)")
+	flag.IntVar(&intervals.RegistryDisk, "interval-registry-disk", 0, "Seconds to wait between registry disk requests; defaults to -interval (int as arg)")
+	flag.IntVar(&intervals.RegistryTemplates, "interval-registry-templates", 0, "Seconds to wait between registry template requests; defaults to -interval (int as arg)")
 	// flag.IntVar(&port, "port", 2112, "Port to server /metrics endpoint (int as arg)")
 	flag.BoolVar(&disableOptimizeInterval, "disable-interval-optimizer", false, "Optimize interval according to /metric api requests received (no args)")
+	flag.BoolVar(&enableProbe, "enable-probe", false, "Serve /probe?target={controller}, which fetches a Controller's data when it is scraped (no args)")
+	flag.BoolVar(&collectOnScrape, "collect-on-scrape", false, "Request data from the controller when /metrics is scraped instead of on an interval (no args)")
+	flag.IntVar(&collectMinAgeSeconds, "collect-min-age", exporter.DEFAULT_COLLECT_MIN_AGE_SECONDS, "With -collect-on-scrape, seconds to reuse the last requested data before requesting it again (int as arg)")
+	flag.StringVar(&stalePolicy, "stale-policy", client.STALE_POLICY_KEEP, "What to do with the series of a data source that keeps failing: keep, drop or mark (NaN values) (string as arg)")
+	flag.IntVar(&staleIntervals, "stale-intervals", exporter.DEFAULT_STALE_INTERVALS, "Number of intervals a data source must fail for before -stale-policy applies (int as arg)")
+	flag.IntVar(&shutdownGraceSeconds, "shutdown-grace-period", exporter.DEFAULT_SHUTDOWN_GRACE_SECONDS, "Seconds to wait for scrapes and data requests in flight on SIGINT/SIGTERM before exiting (int as arg)")
+	flag.StringVar(&stuckThresholds, "stuck-thresholds", "", "Comma separated state=duration pairs; instances in a state for longer are counted as stuck. Example: `Pulling=20m,Stopping=5m,Terminating=10m` (string as arg)")
+	flag.BoolVar(&stuckInstancesInfo, "stuck-instances-info", false, "With -stuck-thresholds, also expose anka_instance_stuck_info with the ID of every stuck instance (no args)")
+	flag.IntVar(&nodeFlapThreshold, "node-flap-threshold", metrics.DEFAULT_NODE_FLAP_THRESHOLD, "Number of state changes within -node-flap-window above which a Node is reported as flapping (int as arg)")
+	flag.IntVar(&nodeFlapWindowSeconds, "node-flap-window", metrics.DEFAULT_NODE_FLAP_WINDOW_SECONDS, "Seconds over which Node state changes are counted for flap detection (int as arg)")
+	flag.StringVar(&inventoryFile, "inventory-file", "", "Path to a YAML file listing the Nodes expected on the Controllers, to report missing, unexpected and misconfigured Nodes (path as arg)")
+	flag.StringVar(&stateFile, "state-file", "", "Path to a file where derived counters (instances created, state transitions...) are checkpointed, so they survive restarts (path as arg)")
+	flag.IntVar(&checkpointSeconds, "checkpoint-interval", exporter.DEFAULT_CHECKPOINT_SECONDS, "With -state-file, seconds to wait between checkpoints; a last one is written on exit (int as arg)")
+	flag.IntVar(&clientConnectTimeoutSeconds, "client-connect-timeout", client.DEFAULT_CONNECT_TIMEOUT_SECONDS, "Seconds to wait for a connection to the controller (int as arg)")
+	flag.IntVar(&clientTLSHandshakeTimeoutSeconds, "client-tls-handshake-timeout", client.DEFAULT_TLS_HANDSHAKE_TIMEOUT_SECONDS, "Seconds to wait for the TLS handshake with the controller (int as arg)")
+	flag.IntVar(&clientRequestTimeoutSeconds, "client-request-timeout", client.DEFAULT_REQUEST_TIMEOUT_SECONDS, "Seconds to wait for a whole request to the controller, response body included (int as arg)")
+	flag.IntVar(&clientMaxConnections, "client-max-connections", client.DEFAULT_MAX_CONNECTIONS, "Maximum number of connections opened to each controller (int as arg)")
+	flag.IntVar(&clientMaxConcurrentRequests, "client-max-concurrent-requests", client.DEFAULT_MAX_CONCURRENT_REQUESTS, "Maximum number of requests in flight to each controller; requests to the same endpoint are always sent one at a time (int as arg)")
 	flag.BoolVar(&useClientTLS, "client-tls", false, "Enable client TLS (no args)")
 	flag.BoolVar(&clientSkipTLSVerification, "client-skip-tls-verification", false, "Skip client TLS verification (no args)")
 	flag.StringVar(&clientCaFilePath, "client-ca-cert", "", "Path to client CA PEM/x509 file (cert file path as arg)")
@@ -60,12 +109,38 @@ func main() {
 	flag.StringVar(&uakString, "uak-string", "", "String form (cat myUAK.pem | sed '1,1d' | sed '$d' | tr -d '\\n') of the key file contents for Controller requests (string as arg)")
 
 	envPrefix := "ANKA_PROMETHEUS_EXPORTER_"
-	envflag.StringVar(&controllerAddress, "CONTROLLER_ADDRESS", "", "Controller address to monitor (url as arg) (required)")
+	envflag.StringVar(&configFile, "CONFIG_FILE", "", "Path to a YAML file listing the Controllers to monitor (path as arg)")
+	envflag.StringVar(&controllerName, "CONTROLLER_NAME", "", "Name used for the controller label of the -controller-address Controller; defaults to its address (name as arg)")
+	envflag.StringVar(&controllerAddress, "CONTROLLER_ADDRESS", "", "Controller address to monitor (url as arg) (required unless -config-file is used)")
 	envflag.StringVar(&controllerUsername, "CONTROLLER_USERNAME", "", "Controller basic auth username (username as arg)")
 	envflag.StringVar(&controllerPassword, "CONTROLLER_PASSWORD", "", "Controller basic auth password (password as arg)")
-	envflag.IntVar(&intervalSeconds, "INTERVAL", DEFAULT_INTERVAL_SECONDS, "Seconds to wait between data requests to controller (int as arg)")
+	envflag.IntVar(&intervalSeconds, "INTERVAL", exporter.DEFAULT_INTERVAL_SECONDS, "Seconds to wait between data requests to controller (int as arg)")
+	envflag.IntVar(&intervals.Status, "INTERVAL_STATUS", 0, "Seconds to wait between status requests; defaults to -interval (int as arg)")
+	envflag.IntVar(&intervals.Nodes, "INTERVAL_NODES", 0, "Seconds to wait between node requests; defaults to -interval (int as arg)")
+	envflag.IntVar(&intervals.Groups, "INTERVAL_GROUPS", 0, "Seconds to wait between group requests; defaults to -interval (int as arg)")
+	envflag.IntVar(&intervals.Vms, "INTERVAL_VMS", 0, "Seconds to wait between vm instance requests; defaults to -interval (int as arg)")
+	envflag.IntVar(&intervals.RegistryDisk, "INTERVAL_REGISTRY_DISK", 0, "Seconds to wait between registry disk requests; defaults to -interval (int as arg)")
+	envflag.IntVar(&intervals.RegistryTemplates, "INTERVAL_REGISTRY_TEMPLATES", 0, "Seconds to wait between registry template requests; defaults to -interval (int as arg)")
 	// envflag.IntVar(&port, "PORT", 2112, "Port to server /metrics endpoint (int as arg)")
 	envflag.BoolVar(&disableOptimizeInterval, "DISABLE_INTERVAL_OPTIMIZER", false, "Optimize interval according to /metric api requests received (no args)")
+	envflag.BoolVar(&enableProbe, "ENABLE_PROBE", false, "Serve /probe?target={controller}, which fetches a Controller's data when it is scraped (no args)")
+	envflag.BoolVar(&collectOnScrape, "COLLECT_ON_SCRAPE", false, "Request data from the controller when /metrics is scraped instead of on an interval (no args)")
+	envflag.IntVar(&collectMinAgeSeconds, "COLLECT_MIN_AGE", exporter.DEFAULT_COLLECT_MIN_AGE_SECONDS, "With -collect-on-scrape, seconds to reuse the last requested data before requesting it again (int as arg)")
+	envflag.StringVar(&stalePolicy, "STALE_POLICY", client.STALE_POLICY_KEEP, "What to do with the series of a data source that keeps failing: keep, drop or mark (NaN values) (string as arg)")
+	envflag.IntVar(&staleIntervals, "STALE_INTERVALS", exporter.DEFAULT_STALE_INTERVALS, "Number of intervals a data source must fail for before -stale-policy applies (int as arg)")
+	envflag.IntVar(&shutdownGraceSeconds, "SHUTDOWN_GRACE_PERIOD", exporter.DEFAULT_SHUTDOWN_GRACE_SECONDS, "Seconds to wait for scrapes and data requests in flight on SIGINT/SIGTERM before exiting (int as arg)")
+	envflag.StringVar(&stuckThresholds, "STUCK_THRESHOLDS", "", "Comma separated state=duration pairs; instances in a state for longer are counted as stuck. Example: `Pulling=20m,Stopping=5m,Terminating=10m` (string as arg)")
+	envflag.BoolVar(&stuckInstancesInfo, "STUCK_INSTANCES_INFO", false, "With -stuck-thresholds, also expose anka_instance_stuck_info with the ID of every stuck instance (no args)")
+	envflag.IntVar(&nodeFlapThreshold, "NODE_FLAP_THRESHOLD", metrics.DEFAULT_NODE_FLAP_THRESHOLD, "Number of state changes within -node-flap-window above which a Node is reported as flapping (int as arg)")
+	envflag.IntVar(&nodeFlapWindowSeconds, "NODE_FLAP_WINDOW", metrics.DEFAULT_NODE_FLAP_WINDOW_SECONDS, "Seconds over which Node state changes are counted for flap detection (int as arg)")
+	envflag.StringVar(&inventoryFile, "INVENTORY_FILE", "", "Path to a YAML file listing the Nodes expected on the Controllers, to report missing, unexpected and misconfigured Nodes (path as arg)")
+	envflag.StringVar(&stateFile, "STATE_FILE", "", "Path to a file where derived counters (instances created, state transitions...) are checkpointed, so they survive restarts (path as arg)")
+	envflag.IntVar(&checkpointSeconds, "CHECKPOINT_INTERVAL", exporter.DEFAULT_CHECKPOINT_SECONDS, "With -state-file, seconds to wait between checkpoints; a last one is written on exit (int as arg)")
+	envflag.IntVar(&clientConnectTimeoutSeconds, "CLIENT_CONNECT_TIMEOUT", client.DEFAULT_CONNECT_TIMEOUT_SECONDS, "Seconds to wait for a connection to the controller (int as arg)")
+	envflag.IntVar(&clientTLSHandshakeTimeoutSeconds, "CLIENT_TLS_HANDSHAKE_TIMEOUT", client.DEFAULT_TLS_HANDSHAKE_TIMEOUT_SECONDS, "Seconds to wait for the TLS handshake with the controller (int as arg)")
+	envflag.IntVar(&clientRequestTimeoutSeconds, "CLIENT_REQUEST_TIMEOUT", client.DEFAULT_REQUEST_TIMEOUT_SECONDS, "Seconds to wait for a whole request to the controller, response body included (int as arg)")
+	envflag.IntVar(&clientMaxConnections, "CLIENT_MAX_CONNECTIONS", client.DEFAULT_MAX_CONNECTIONS, "Maximum number of connections opened to each controller (int as arg)")
+	envflag.IntVar(&clientMaxConcurrentRequests, "CLIENT_MAX_CONCURRENT_REQUESTS", client.DEFAULT_MAX_CONCURRENT_REQUESTS, "Maximum number of requests in flight to each controller; requests to the same endpoint are always sent one at a time (int as arg)")
 	envflag.BoolVar(&useClientTLS, "CLIENT_TLS", false, "Enable client TLS (no args)")
 	envflag.BoolVar(&clientSkipTLSVerification, "CLIENT_SKIP_TLS_VERIFICATION", false, "Skip client TLS verification (no args)")
 	envflag.StringVar(&clientCaFilePath, "CLIENT_CA_CERT", "", "Path to client CA PEM/x509 file (cert file path as arg)")
@@ -82,7 +157,7 @@ func main() {
 		webListenAddresses = ":2112"
 	}
 
-	if controllerAddress == "" {
+	if controllerAddress == "" && configFile == "" {
 		log.Fatal(fmt.Sprintf("controller address not supplied (%sCONTROLLER_ADDRESS=\"http://{address}:{port}\" or --controller-address http://{address}:{port})", envPrefix))
 	}
 
@@ -92,42 +167,88 @@ func main() {
 
 	log.Info(fmt.Sprintf("Starting Prometheus Exporter for Anka (%s)", version))
 
-	clientTLSCerts := client.ClientTLSCerts{
-		UseTLS:              useClientTLS,
-		Cert:                clientCertPath,
-		CertKey:             clientCertKeyPath,
-		CACert:              clientCaFilePath,
-		SkipTLSVerification: clientSkipTLSVerification,
+	exporterConfig := &config.Config{}
+	if configFile != "" {
+		var err error
+		exporterConfig, err = config.Load(configFile)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("Error loading config file: %s", err.Error()))
+		}
 	}
-
-	clientUAK := client.UAK{
-		ID:        uakId,
-		KeyPath:   uakPath,
-		KeyString: uakString,
+	if controllerAddress != "" {
+		exporterConfig.Controllers = append(exporterConfig.Controllers, config.Controller{
+			Name:    controllerName,
+			Address: controllerAddress,
+			Module: config.Module{
+				Username: controllerUsername,
+				Password: controllerPassword,
+				UAK: config.ControllerUAK{
+					ID:     uakId,
+					Path:   uakPath,
+					String: uakString,
+				},
+				TLS: config.ControllerTLS{
+					Enabled:          useClientTLS,
+					CACert:           clientCaFilePath,
+					Cert:             clientCertPath,
+					CertKey:          clientCertKeyPath,
+					SkipVerification: clientSkipTLSVerification,
+				},
+			},
+		})
 	}
-
-	client, err := client.NewClient(controllerAddress, controllerUsername, controllerPassword, intervalSeconds, clientTLSCerts, clientUAK)
+	parsedStuckThresholds, err := metrics.ParseStuckThresholds(stuckThresholds)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("Error creating client: %s", err.Error()))
+		log.Fatal(err.Error())
 	}
-	client.Init()
 
-	prometheusRegistry := prometheus.NewRegistry()
-
-	// Create each metric that we later populate
-	for _, m := range metrics.MetricsHolder {
-		prometheusRegistry.Register(m.GetPrometheusMetric())
-		client.Register(m.GetEvent(), m.GetEventHandler())
+	var expectedInventory *inventory.Inventory
+	if inventoryFile != "" {
+		expectedInventory, err = inventory.Load(inventoryFile)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("Error loading inventory file: %s", err.Error()))
+		}
 	}
 
-	srv := server.NewServer(
-		prometheusRegistry,
-		webListenAddresses,
-		version,
-		webConfigFile,
-	)
-	if !disableOptimizeInterval {
-		srv.SetIntervalUpdateFunc(client.UpdateInterval)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ankaExporter, err := exporter.New(exporter.Options{
+		Config:                   exporterConfig,
+		IntervalSeconds:          intervalSeconds,
+		Intervals:                intervals,
+		DisableIntervalOptimizer: disableOptimizeInterval,
+		EnableProbe:              enableProbe,
+		CollectOnScrape:          collectOnScrape,
+		CollectMinAgeSeconds:     collectMinAgeSeconds,
+		StalePolicy:              stalePolicy,
+		StaleIntervals:           staleIntervals,
+		ShutdownGraceSeconds:     shutdownGraceSeconds,
+		HTTP: client.HTTPOptions{
+			ConnectTimeout:      time.Duration(clientConnectTimeoutSeconds) * time.Second,
+			TLSHandshakeTimeout: time.Duration(clientTLSHandshakeTimeoutSeconds) * time.Second,
+			RequestTimeout:      time.Duration(clientRequestTimeoutSeconds) * time.Second,
+			MaxConnections:      clientMaxConnections,
+			MaxConcurrent:       clientMaxConcurrentRequests,
+		},
+		Metrics: metrics.Options{
+			StuckThresholds:    parsedStuckThresholds,
+			StuckInstancesInfo: stuckInstancesInfo,
+			NodeFlapThreshold:  nodeFlapThreshold,
+			NodeFlapWindow:     time.Duration(nodeFlapWindowSeconds) * time.Second,
+			Inventory:          expectedInventory,
+		},
+		StateFile:         stateFile,
+		CheckpointSeconds: checkpointSeconds,
+		WebListenAddress:  webListenAddresses,
+		WebConfigFile:     webConfigFile,
+		Version:           version,
+	})
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Error creating exporter: %s", err.Error()))
+	}
+	if err := ankaExporter.Run(ctx); err != nil {
+		log.Fatal(err.Error())
 	}
-	srv.Init()
+	log.Info("Exporter stopped")
 }
@@ -0,0 +1,114 @@
+package checkpoint
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/veertuinc/anka-prometheus-exporter/src/metrics"
+)
+
+// CHECKPOINT_VERSION is bumped whenever the format of Checkpoint changes; files of other versions are skipped
+const CHECKPOINT_VERSION = 1
+
+// Checkpoint holds the derived counters and last seen resources of every Controller, by Controller name
+type Checkpoint struct {
+	SavedAt     time.Time             `json:"saved_at"`
+	Controllers map[string]Controller `json:"controllers"`
+}
+
+type Controller struct {
+	LastSeen metrics.LastSeen                   `json:"last_seen"`
+	Counters map[string][]metrics.CounterSample `json:"counters"` // by metric name
+}
+
+func New() *Checkpoint {
+	return &Checkpoint{SavedAt: time.Now(), Controllers: map[string]Controller{}}
+}
+
+// Controller returns the checkpoint of a Controller; it is safe to call on a nil Checkpoint
+func (checkpoint *Checkpoint) Controller(name string) (Controller, bool) {
+	if checkpoint == nil {
+		return Controller{}, false
+	}
+	controller, ok := checkpoint.Controllers[name]
+	return controller, ok
+}
+
+// file is the envelope written to disk; the checksum covers data, so truncated or altered checkpoints are detected
+type file struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// Load reads the checkpoint at path; it returns nil and no error when the file doesn't exist yet
+func Load(path string) (*Checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading checkpoint %s: %w", path, err)
+	}
+	f := file{}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parsing checkpoint %s: %w", path, err)
+	}
+	if f.Version != CHECKPOINT_VERSION {
+		return nil, fmt.Errorf("checkpoint %s has version %d, expected %d", path, f.Version, CHECKPOINT_VERSION)
+	}
+	if f.Checksum != checksum(f.Data) {
+		return nil, fmt.Errorf("checkpoint %s is corrupted: checksum mismatch", path)
+	}
+	checkpoint := New()
+	if err := json.Unmarshal(f.Data, checkpoint); err != nil {
+		return nil, fmt.Errorf("parsing checkpoint %s: %w", path, err)
+	}
+	if checkpoint.Controllers == nil {
+		checkpoint.Controllers = map[string]Controller{}
+	}
+	return checkpoint, nil
+}
+
+// Save writes the checkpoint to a temporary file renamed over path, so a crash never leaves a half-written checkpoint behind
+func (checkpoint *Checkpoint) Save(path string) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	contents, err := json.Marshal(file{Version: CHECKPOINT_VERSION, Checksum: checksum(data), Data: data})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("writing checkpoint %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing checkpoint %s: %w", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing checkpoint %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing checkpoint %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("writing checkpoint %s: %w", path, err)
+	}
+	return nil
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
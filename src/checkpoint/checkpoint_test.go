@@ -0,0 +1,81 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/veertuinc/anka-prometheus-exporter/src/metrics"
+)
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	saved := New()
+	saved.Controllers["default"] = Controller{
+		LastSeen: metrics.LastSeen{InstancesLoaded: true},
+		Counters: map[string][]metrics.CounterSample{
+			"anka_instance_created_total": {{Labels: map[string]string{"arch": "arm64"}, Value: 3}},
+		},
+	}
+	if err := saved.Save(path); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+	controller, ok := loaded.Controller("default")
+	if !ok {
+		t.Fatal("the saved controller is missing")
+	}
+	if !controller.LastSeen.InstancesLoaded {
+		t.Error("InstancesLoaded = false, expected true")
+	}
+	samples := controller.Counters["anka_instance_created_total"]
+	if len(samples) != 1 || samples[0].Value != 3 || samples[0].Labels["arch"] != "arm64" {
+		t.Errorf("samples = %+v", samples)
+	}
+}
+
+func TestLoadMissing(t *testing.T) {
+	checkpoint, err := Load(filepath.Join(t.TempDir(), "checkpoint.json"))
+	if checkpoint != nil || err != nil {
+		t.Fatalf("Load() = %v, %v; expected nil, nil", checkpoint, err)
+	}
+	if _, ok := checkpoint.Controller("default"); ok {
+		t.Fatal("a nil checkpoint has a controller")
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	data := []byte(`{"saved_at":"2024-01-01T00:00:00Z","controllers":{}}`)
+	envelope := func(f file) []byte {
+		contents, err := json.Marshal(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+	tests := []struct {
+		name     string
+		contents []byte
+	}{
+		{name: "garbage", contents: []byte("not json")},
+		{name: "truncated", contents: envelope(file{Version: CHECKPOINT_VERSION, Checksum: checksum(data), Data: data})[:40]},
+		{name: "other version", contents: envelope(file{Version: CHECKPOINT_VERSION + 1, Checksum: checksum(data), Data: data})},
+		{name: "checksum mismatch", contents: envelope(file{Version: CHECKPOINT_VERSION, Checksum: checksum([]byte("{}")), Data: data})},
+		{name: "data not a checkpoint", contents: envelope(file{Version: CHECKPOINT_VERSION, Checksum: checksum([]byte(`[]`)), Data: []byte(`[]`)})},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "checkpoint.json")
+			if err := os.WriteFile(path, test.contents, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if checkpoint, err := Load(path); err == nil {
+				t.Fatalf("Load() = %+v, expected an error", checkpoint)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/veertuinc/anka-prometheus-exporter/src/log"
+)
+
+const (
+	BACKOFF_BASE_SECONDS              = 2
+	BACKOFF_MAX_SECONDS               = 120
+	CIRCUIT_BREAKER_FAILURE_THRESHOLD = 10 // consecutive failures, across every data source, before the breaker opens
+	CIRCUIT_BREAKER_OPEN_SECONDS      = 30 // first wait before a half-open probe; doubled (up to BACKOFF_MAX_SECONDS) after every failed probe
+)
+
+const (
+	CIRCUIT_CLOSED    = "closed"
+	CIRCUIT_OPEN      = "open"
+	CIRCUIT_HALF_OPEN = "half_open"
+)
+
+var circuitStates = []string{CIRCUIT_CLOSED, CIRCUIT_OPEN, CIRCUIT_HALF_OPEN}
+
+// backoff computes the wait after consecutive failures of one endpoint: base * 2^failures capped at max, with jitter so loops don't retry in lockstep
+type backoff struct {
+	base     time.Duration
+	max      time.Duration
+	failures int
+}
+
+func newBackoff(base, max time.Duration) *backoff {
+	return &backoff{base: base, max: max}
+}
+
+func (b *backoff) next() time.Duration {
+	wait := b.max
+	if b.failures < 32 && b.base<<b.failures < b.max {
+		wait = b.base << b.failures
+	}
+	b.failures++
+	// "equal jitter": at least half the wait, so a struggling Controller still gets a break
+	return wait/2 + rand.N(wait/2+1)
+}
+
+func (b *backoff) reset() {
+	b.failures = 0
+}
+
+// circuitBreaker pauses every data loop of a Client after repeated failures, then probes /api/v1/status until the Controller answers again
+type circuitBreaker struct {
+	name      string
+	threshold int
+	failures  int
+	state     string
+	closed    chan struct{} // closed while the breaker is closed; loops wait on it while the breaker is open
+	probe     func(ctx context.Context) error
+	openWait  *backoff
+	stateDesc *prometheus.GaugeVec
+	trips     prometheus.Counter
+	lock      *sync.Mutex
+}
+
+func newCircuitBreaker(name string, probe func(ctx context.Context) error) *circuitBreaker {
+	closed := make(chan struct{})
+	close(closed)
+	cb := &circuitBreaker{
+		name:      name,
+		threshold: CIRCUIT_BREAKER_FAILURE_THRESHOLD,
+		state:     CIRCUIT_CLOSED,
+		closed:    closed,
+		probe:     probe,
+		openWait:  newBackoff(CIRCUIT_BREAKER_OPEN_SECONDS*time.Second, BACKOFF_MAX_SECONDS*time.Second),
+		stateDesc: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "anka_exporter_circuit_breaker_state",
+			Help: "Current state of the circuit breaker pausing requests to a failing Controller (label: state)",
+		}, []string{"state"}),
+		trips: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "anka_exporter_circuit_breaker_trips_total",
+			Help: "Count of times the circuit breaker opened after repeated failures",
+		}),
+		lock: &sync.Mutex{},
+	}
+	cb.setState(CIRCUIT_CLOSED)
+	return cb
+}
+
+func (cb *circuitBreaker) collectors() []prometheus.Collector {
+	return []prometheus.Collector{cb.stateDesc, cb.trips}
+}
+
+// must be called with the lock held
+func (cb *circuitBreaker) setState(state string) {
+	cb.state = state
+	for _, s := range circuitStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		cb.stateDesc.WithLabelValues(s).Set(value)
+	}
+}
+
+// allow reports whether requests may be sent to the Controller
+func (cb *circuitBreaker) allow() bool {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return cb.state == CIRCUIT_CLOSED
+}
+
+// wait blocks while the breaker is open; it returns the context error if ctx is done first
+func (cb *circuitBreaker) wait(ctx context.Context) error {
+	cb.lock.Lock()
+	closed := cb.closed
+	cb.lock.Unlock()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-closed:
+		return nil
+	}
+}
+
+func (cb *circuitBreaker) success() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if cb.state == CIRCUIT_CLOSED {
+		cb.failures = 0
+	}
+}
+
+// failure opens the breaker once the threshold is reached; the half-open probes run with ctx
+func (cb *circuitBreaker) failure(ctx context.Context) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if cb.state != CIRCUIT_CLOSED {
+		return
+	}
+	cb.failures++
+	if cb.failures < cb.threshold {
+		return
+	}
+	log.Warn(fmt.Sprintf("[controller::%s] %d consecutive failures, pausing requests to the Controller", cb.name, cb.failures))
+	cb.trips.Inc()
+	cb.closed = make(chan struct{})
+	cb.setState(CIRCUIT_OPEN)
+	go cb.probeUntilClosed(ctx)
+}
+
+func (cb *circuitBreaker) probeUntilClosed(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cb.openWait.next()):
+		}
+		cb.lock.Lock()
+		cb.setState(CIRCUIT_HALF_OPEN)
+		cb.lock.Unlock()
+
+		err := cb.probe(ctx)
+
+		cb.lock.Lock()
+		if err == nil {
+			log.Info(fmt.Sprintf("[controller::%s] Controller is answering again, resuming requests", cb.name))
+			cb.failures = 0
+			cb.openWait.reset()
+			cb.setState(CIRCUIT_CLOSED)
+			close(cb.closed)
+			cb.lock.Unlock()
+			return
+		}
+		if ctx.Err() == nil {
+			log.Warn(fmt.Sprintf("[controller::%s] half-open probe failed: %+v", cb.name, err))
+		}
+		cb.setState(CIRCUIT_OPEN)
+		cb.lock.Unlock()
+	}
+}
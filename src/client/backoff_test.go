@@ -0,0 +1,194 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoffNext(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     time.Duration
+		max      time.Duration
+		failures int
+		wait     time.Duration // un-jittered wait; next returns between half of it and all of it
+	}{
+		{name: "first failure", base: 2 * time.Second, max: 120 * time.Second, failures: 0, wait: 2 * time.Second},
+		{name: "doubles", base: 2 * time.Second, max: 120 * time.Second, failures: 3, wait: 16 * time.Second},
+		{name: "capped at max", base: 2 * time.Second, max: 120 * time.Second, failures: 6, wait: 120 * time.Second},
+		{name: "shift overflow", base: 2 * time.Second, max: 120 * time.Second, failures: 40, wait: 120 * time.Second},
+		{name: "base above max", base: time.Minute, max: time.Second, failures: 0, wait: time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				b := newBackoff(test.base, test.max)
+				b.failures = test.failures
+				if wait := b.next(); wait < test.wait/2 || wait > test.wait {
+					t.Fatalf("next() = %s, expected between %s and %s", wait, test.wait/2, test.wait)
+				}
+				if b.failures != test.failures+1 {
+					t.Fatalf("failures = %d after next(), expected %d", b.failures, test.failures+1)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffReset(t *testing.T) {
+	b := newBackoff(time.Second, time.Minute)
+	for i := 0; i < 10; i++ {
+		b.next()
+	}
+	b.reset()
+	if wait := b.next(); wait > time.Second {
+		t.Fatalf("next() = %s after reset(), expected at most %s", wait, time.Second)
+	}
+}
+
+// testBreaker returns a breaker with a short open wait; each half-open probe signals on started, then returns the error sent on probes
+func testBreaker(t *testing.T, threshold int) (cb *circuitBreaker, started chan struct{}, probes chan error) {
+	t.Helper()
+	started = make(chan struct{})
+	probes = make(chan error)
+	cb = newCircuitBreaker("test", func(ctx context.Context) error {
+		select {
+		case started <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case err := <-probes:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	cb.threshold = threshold
+	cb.openWait = newBackoff(time.Millisecond, time.Millisecond)
+	return cb, started, probes
+}
+
+func breakerState(cb *circuitBreaker) string {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return cb.state
+}
+
+func waitForState(t *testing.T, cb *circuitBreaker, state string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for breakerState(cb) != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("breaker is %s, expected %s", breakerState(cb), state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCircuitBreakerOpens(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []bool // true for a successful request
+		state   string
+	}{
+		{name: "no requests", results: nil, state: CIRCUIT_CLOSED},
+		{name: "below threshold", results: []bool{false, false}, state: CIRCUIT_CLOSED},
+		{name: "at threshold", results: []bool{false, false, false}, state: CIRCUIT_OPEN},
+		{name: "success resets failures", results: []bool{false, false, true, false, false}, state: CIRCUIT_CLOSED},
+		{name: "consecutive failures after success", results: []bool{false, true, false, false, false}, state: CIRCUIT_OPEN},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			cb, _, _ := testBreaker(t, 3)
+			cb.openWait = newBackoff(time.Hour, time.Hour) // keep the breaker open: no probe runs during the test
+			for _, ok := range test.results {
+				if ok {
+					cb.success()
+				} else {
+					cb.failure(ctx)
+				}
+			}
+			if state := breakerState(cb); state != test.state {
+				t.Fatalf("breaker is %s, expected %s", state, test.state)
+			}
+			if allowed := cb.allow(); allowed != (test.state == CIRCUIT_CLOSED) {
+				t.Fatalf("allow() = %t while the breaker is %s", allowed, test.state)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerProbes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cb, started, probes := testBreaker(t, 1)
+
+	cb.failure(ctx)
+	if cb.allow() {
+		t.Fatal("allow() = true after the breaker opened")
+	}
+	waitCtx, cancelWait := context.WithTimeout(ctx, 10*time.Millisecond)
+	if err := cb.wait(waitCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wait() = %v while the breaker is open, expected %v", err, context.DeadlineExceeded)
+	}
+	cancelWait()
+
+	// a failed probe opens the breaker again
+	<-started
+	if state := breakerState(cb); state != CIRCUIT_HALF_OPEN {
+		t.Fatalf("breaker is %s while probing, expected %s", state, CIRCUIT_HALF_OPEN)
+	}
+	if cb.allow() {
+		t.Fatal("allow() = true while the breaker is half-open")
+	}
+	probes <- errors.New("connection refused")
+	<-started // the next probe
+	if cb.openWait.failures != 2 {
+		t.Fatalf("open wait failures = %d after a failed probe, expected 2", cb.openWait.failures)
+	}
+
+	// a successful probe closes it and releases the waiting loops
+	waited := make(chan error)
+	go func() { waited <- cb.wait(ctx) }()
+	probes <- nil
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Fatalf("wait() = %v after the breaker closed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait() still blocked after the breaker closed")
+	}
+	if state := breakerState(cb); state != CIRCUIT_CLOSED {
+		t.Fatalf("breaker is %s, expected %s", state, CIRCUIT_CLOSED)
+	}
+	if !cb.allow() {
+		t.Fatal("allow() = false after the breaker closed")
+	}
+	if cb.failures != 0 || cb.openWait.failures != 0 {
+		t.Fatalf("failures = %d, open wait failures = %d after the breaker closed, expected 0", cb.failures, cb.openWait.failures)
+	}
+
+	// it opens again on new failures
+	cb.failure(ctx)
+	if state := breakerState(cb); state != CIRCUIT_OPEN {
+		t.Fatalf("breaker is %s, expected %s", state, CIRCUIT_OPEN)
+	}
+}
+
+func TestCircuitBreakerProbesStopWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cb, started, _ := testBreaker(t, 1)
+	cb.failure(ctx)
+	<-started
+	cancel()
+	waitForState(t, cb, CIRCUIT_OPEN)
+	if err := cb.wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("wait() = %v, expected %v", err, context.Canceled)
+	}
+}
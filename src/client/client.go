@@ -1,16 +1,17 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"reflect"
-	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/veertuinc/anka-prometheus-exporter/src/events"
 	"github.com/veertuinc/anka-prometheus-exporter/src/log"
+	"github.com/veertuinc/anka-prometheus-exporter/src/state"
 )
 
 const (
@@ -18,112 +19,216 @@ const (
 )
 
 type Client struct {
-	events              map[events.Event][]func(interface{}) error
-	communicator        *Communicator
-	timeoutSeconds      int64
-	errorTimeoutSeconds int
-	eventsMutex         sync.Mutex
+	name           string
+	bus            *events.Bus
+	dataSources    []DataSource
+	communicator   *Communicator
+	intervals      map[string]*sourceInterval
+	breaker        *circuitBreaker
+	health         *sourceHealth
+	loops          *sync.WaitGroup
+	stalePolicy    string
+	staleIntervals int
 }
 
-func NewClient(addr, username, password string, interval int, certs ClientTLSCerts, uak UAK) (*Client, error) {
-	communicator, err := NewCommunicator(addr, username, password, certs, uak)
+// NewClient makes no request to the Controller: Init and Connect reach it in the background, so a stalled Controller never holds back the others
+func NewClient(name, addr, username, password string, interval int, certs ClientTLSCerts, httpOptions HTTPOptions, uak UAK) (*Client, error) {
+	communicator, err := NewCommunicator(addr, username, password, certs, httpOptions, uak)
 	if err != nil || communicator == nil {
 		log.Error("Failed to create communicator")
 		return nil, fmt.Errorf("failed to create communicator: %v", err)
 	}
+	bus := events.NewBus(name)
 	c := &Client{
-		events: map[events.Event][]func(interface{}) error{
-			events.EVENT_NODE_UPDATED:               make([]func(interface{}) error, 0),
-			events.EVENT_REGISTRY_DISK_DATA_UPDATED: make([]func(interface{}) error, 0),
-			events.EVENT_VM_DATA_UPDATED:            make([]func(interface{}) error, 0),
-			events.EVENT_REGISTRY_TEMPLATES_UPDATED: make([]func(interface{}) error, 0),
-			events.EVENT_STATUS_UPDATED:             make([]func(interface{}) error, 0),
-		},
-		communicator:        communicator,
-		timeoutSeconds:      int64(interval),
-		errorTimeoutSeconds: 10,
+		name:         name,
+		bus:          bus,
+		dataSources:  communicator.DataSources(bus),
+		communicator: communicator,
+		intervals:    make(map[string]*sourceInterval),
+		health:       newSourceHealth(),
+		loops:        &sync.WaitGroup{},
+		stalePolicy:  STALE_POLICY_KEEP,
 	}
-	if err := c.communicator.TestConnection(); err != nil {
-		response, err := c.communicator.getResponse("/api/v1/status", "", "")
-		if err != nil {
-			log.Error(fmt.Sprintf("Error getting response: %s", err.Error()))
-		} else {
-			bodyBytes := make([]byte, 1024)
-			for {
-				n, err := response.Body.Read(bodyBytes)
-				if n > 0 {
-					log.Error(fmt.Sprintf("call to %s returned %d code and body of '%s'", response.Request.URL, response.StatusCode, string(bodyBytes[:n])))
-					return nil, fmt.Errorf("failed to test connection")
-				}
-				if err != nil {
-					if err != io.EOF {
-						log.Error(fmt.Sprintf("Error reading response body: %s", err.Error()))
-						return nil, fmt.Errorf("failed to test connection")
-					}
-					break
-				}
-			}
-		}
-		return nil, err
+	for _, dataSource := range c.dataSources {
+		c.intervals[dataSource.Name] = &sourceInterval{seconds: int64(interval), fixed: !followsScrapes(dataSource.Name)}
 	}
+	c.breaker = newCircuitBreaker(name, communicator.TestConnection)
 	return c, nil
 }
 
-func (client *Client) Init() {
-	// We must first populate the data from the Controller API that is going to be stored in state before we attempt to create metrics from it
-	// Order matters here since GetVmsData for example relies on RegistryTemplatesData
-	_, err := client.communicator.GetRegistryTemplatesData()
+// connect obtains the UAK session and tests the connection. An unreachable Controller must not keep the others from being monitored:
+// failures are only logged, the data loops retry and report the sources down meanwhile.
+func (client *Client) connect(ctx context.Context) {
+	client.communicator.Connect(ctx)
+	if testErr := client.communicator.TestConnection(ctx); testErr != nil && ctx.Err() == nil {
+		client.logConnectionFailure(ctx, testErr)
+	}
+}
+
+// logConnectionFailure logs why the connection test failed, with the start of the status response when there is one
+func (client *Client) logConnectionFailure(ctx context.Context, testErr error) {
+	log.Error(fmt.Sprintf("[controller::%s] Failed to test connection (the data loops will keep retrying): %v", client.name, testErr))
+	response, err := client.communicator.getResponse(ctx, "/api/v1/status", client.communicator.username, client.communicator.password)
 	if err != nil {
-		log.Error(fmt.Sprintf("Error getting registry templates data: %v", err))
+		log.Error(fmt.Sprintf("Error getting response: %s", err.Error()))
+		return
 	}
-	go client.initDataLoop(client.communicator.GetNodesData, events.EVENT_NODE_UPDATED)
-	go client.initDataLoop(client.communicator.GetVmsData, events.EVENT_VM_DATA_UPDATED)
-	go client.initDataLoop(client.communicator.GetRegistryDiskData, events.EVENT_REGISTRY_DISK_DATA_UPDATED)
-	go client.initDataLoop(client.communicator.GetRegistryTemplatesData, events.EVENT_REGISTRY_TEMPLATES_UPDATED)
-	go client.initDataLoop(client.communicator.GetStatus, events.EVENT_STATUS_UPDATED)
-}
-
-func (client *Client) Register(ev events.Event, eventHandler func(interface{}) error) error {
-	client.eventsMutex.Lock()
-	defer client.eventsMutex.Unlock()
-	val, ok := client.events[ev]
-	if ok {
-		client.events[ev] = append(val, eventHandler)
-	} else {
-		return fmt.Errorf("no such event id: %v", ev)
+	defer response.Body.Close()
+	bodyBytes := make([]byte, 1024)
+	n, err := io.ReadFull(response.Body, bodyBytes)
+	if n > 0 {
+		log.Error(fmt.Sprintf("call to %s returned %d code and body of '%s'", response.Request.URL, response.StatusCode, string(bodyBytes[:n])))
+	} else if err != nil && err != io.EOF {
+		log.Error(fmt.Sprintf("Error reading response body: %s", err.Error()))
+	}
+}
+
+func (client *Client) Name() string {
+	return client.name
+}
+
+// Bus returns the event bus the Controller data is published to; metrics subscribe to its topics
+func (client *Client) Bus() *events.Bus {
+	return client.bus
+}
+
+// State returns the snapshots of the Controller resources; they are updated before the data is published to the bus
+func (client *Client) State() *state.State {
+	return client.communicator.State()
+}
+
+// Collectors returns the metrics instrumenting the requests made to the Controller and the event handlers
+func (client *Client) Collectors() []prometheus.Collector {
+	collectors := append(client.communicator.Collectors(), client.bus.Collectors()...)
+	return append(collectors, client.breaker.collectors()...)
+}
+
+// Init connects to the Controller, then polls every data source until ctx is done; requests in flight are cancelled with ctx.
+// It returns right away: the connection test and first requests run in the background.
+func (client *Client) Init(ctx context.Context) {
+	client.loops.Add(1)
+	go func() {
+		defer client.loops.Done()
+		client.connect(ctx)
+		// We must first populate the data from the Controller API that is going to be stored in state before we attempt to create metrics from it
+		// Order matters here since GetVmsData for example relies on RegistryTemplatesData
+		_, err := client.communicator.GetRegistryTemplatesData(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Error(fmt.Sprintf("[controller::%s] Error getting registry templates data: %v", client.name, err))
+		}
+		for _, dataSource := range client.dataSources {
+			client.loops.Add(1)
+			go func(dataSource DataSource) {
+				defer client.loops.Done()
+				client.initDataLoop(ctx, dataSource)
+			}(dataSource)
+		}
+	}()
+}
+
+// Connect obtains the UAK session and tests the connection in the background, for Clients refreshed on scrape rather than by Init
+func (client *Client) Connect(ctx context.Context) {
+	client.loops.Add(1)
+	go func() {
+		defer client.loops.Done()
+		client.connect(ctx)
+	}()
+}
+
+// Wait blocks until the background work started by Init or Connect has returned
+func (client *Client) Wait() {
+	client.loops.Wait()
+}
+
+// sourceInterval is the polling interval of one data source. Sources without their own interval follow the scrape frequency (interval optimizer).
+type sourceInterval struct {
+	seconds int64
+	fixed   bool // given its own interval, or a registry source
+}
+
+// followsScrapes tells whether the interval optimizer applies to the source; the registry changes rarely, so its sources keep the
+// base interval unless given their own
+func followsScrapes(source string) bool {
+	return source != events.EVENT_REGISTRY_TEMPLATES_UPDATED.String() && source != events.EVENT_REGISTRY_DISK_DATA_UPDATED.String()
+}
+
+// SetIntervals gives data sources (by name: status, nodes, groups, vms, registry_disk, registry_templates) their own polling interval in seconds.
+// The interval optimizer leaves these sources alone; zero values are ignored.
+func (client *Client) SetIntervals(intervals map[string]int) error {
+	for name, seconds := range intervals {
+		interval, ok := client.intervals[name]
+		if !ok {
+			return fmt.Errorf("unknown data source %s", name)
+		}
+		if seconds <= 0 {
+			continue
+		}
+		atomic.StoreInt64(&interval.seconds, int64(seconds))
+		interval.fixed = true
 	}
 	return nil
 }
 
+func (client *Client) interval(source string) time.Duration {
+	return time.Duration(atomic.LoadInt64(&client.intervals[source].seconds)) * time.Second
+}
+
+// UpdateInterval applies the interval optimizer to the data sources tied to the scrape frequency; the registry sources keep their own cadence
 func (client *Client) UpdateInterval(i int64) {
-	if i > 1 {
-		if i > MAX_INTERVAL_SECONDS {
-			atomic.StoreInt64(&client.timeoutSeconds, MAX_INTERVAL_SECONDS)
-		} else {
-			atomic.StoreInt64(&client.timeoutSeconds, i-1)
+	if i <= 1 {
+		return
+	}
+	seconds := i - 1
+	if i > MAX_INTERVAL_SECONDS {
+		seconds = MAX_INTERVAL_SECONDS
+	}
+	for _, interval := range client.intervals {
+		if !interval.fixed {
+			atomic.StoreInt64(&interval.seconds, seconds)
 		}
 	}
 }
 
-// Loops over each eventHandler inside of the metrics/metric_*.go files and populates the values for each metric
-func (client *Client) initDataLoop(f func() (interface{}, error), ev events.Event) {
+// Refreshes the data source on an interval; the metrics/*.go handlers subscribed to its topic populate the values for each metric.
+// Failures back off exponentially per data source, and every loop pauses while the circuit breaker is open.
+func (client *Client) initDataLoop(ctx context.Context, dataSource DataSource) {
+	retry := newBackoff(BACKOFF_BASE_SECONDS*time.Second, BACKOFF_MAX_SECONDS*time.Second)
 	for {
-		log.Debug("Requesting data for: " + runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name())
-		data, err := f()
-		if err != nil {
-			log.Error(fmt.Sprintf("could not get data: %+v", err))
-			time.Sleep(time.Duration(client.errorTimeoutSeconds) * time.Second)
-			continue
+		if err := client.breaker.wait(ctx); err != nil {
+			return
 		}
-		client.eventsMutex.Lock()
-		events := client.events[ev]
-		client.eventsMutex.Unlock()
-		for _, eventHandler := range events {
-			if err := eventHandler(data); err != nil {
-				log.Error(fmt.Sprintf("ignoring event handler failure for event id %+v - Error: %+v", ev, err))
+		wait := client.interval(dataSource.Name)
+		if err := client.refresh(ctx, dataSource); err != nil {
+			if ctx.Err() != nil {
+				return
 			}
+			client.breaker.failure(ctx)
+			wait = retry.next()
+			log.Error(fmt.Sprintf("[controller::%s] could not get data (retrying in %s): %+v", client.name, wait.Round(time.Millisecond), err))
+		} else {
+			client.breaker.success()
+			retry.reset()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
 		}
-		log.Debug("Finished requesting data for: " + runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name())
-		time.Sleep(time.Duration(atomic.LoadInt64(&client.timeoutSeconds)) * time.Second)
 	}
 }
+
+// Fetches the data source once and publishes the data to every handler subscribed to its topic
+func (client *Client) refresh(ctx context.Context, dataSource DataSource) error {
+	log.Debug("[controller::" + client.name + "] Requesting data for: " + dataSource.Name)
+	err := dataSource.Refresh(ctx)
+	if ctx.Err() != nil {
+		// cancelled requests say nothing about the health of the Controller
+		return err
+	}
+	client.health.observe(dataSource.Name, err)
+	if err != nil {
+		return err
+	}
+	log.Debug("[controller::" + client.name + "] Finished requesting data for: " + dataSource.Name)
+	return nil
+}
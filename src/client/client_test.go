@@ -0,0 +1,52 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdateInterval(t *testing.T) {
+	tests := []struct {
+		name      string
+		intervals map[string]int // configured explicitly
+		expected  map[string]time.Duration
+	}{
+		{
+			name: "defaults",
+			expected: map[string]time.Duration{
+				"status":             9 * time.Second,
+				"nodes":              9 * time.Second,
+				"vms":                9 * time.Second,
+				"registry_disk":      15 * time.Second,
+				"registry_templates": 15 * time.Second,
+			},
+		},
+		{
+			name:      "configured explicitly",
+			intervals: map[string]int{"nodes": 30, "registry_templates": 300},
+			expected: map[string]time.Duration{
+				"status":             9 * time.Second,
+				"nodes":              30 * time.Second,
+				"registry_disk":      15 * time.Second,
+				"registry_templates": 300 * time.Second,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := NewClient("test", "http://127.0.0.1:1", "", "", 15, ClientTLSCerts{}, HTTPOptions{}, UAK{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.SetIntervals(test.intervals); err != nil {
+				t.Fatal(err)
+			}
+			c.UpdateInterval(10)
+			for source, expected := range test.expected {
+				if interval := c.interval(source); interval != expected {
+					t.Errorf("%s polled every %s, expected %s", source, interval, expected)
+				}
+			}
+		})
+	}
+}
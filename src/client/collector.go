@@ -0,0 +1,106 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/veertuinc/anka-prometheus-exporter/src/events"
+	"github.com/veertuinc/anka-prometheus-exporter/src/log"
+	"github.com/veertuinc/anka-prometheus-exporter/src/state"
+)
+
+// ScrapeCollector fetches the Controller data when Prometheus scrapes /metrics instead of polling on a timer.
+// Results are cached for minAge so that concurrent scrapes (like from an HA Prometheus pair) share one fetch.
+type ScrapeCollector struct {
+	ctx        context.Context
+	client     *Client
+	collectors []prometheus.Collector
+	minAge     time.Duration
+	lastFetch  time.Time
+	lock       *sync.Mutex
+}
+
+// NewScrapeCollector creates a collector whose requests to the Controller are cancelled with ctx
+func (client *Client) NewScrapeCollector(ctx context.Context, minAge time.Duration) *ScrapeCollector {
+	return &ScrapeCollector{
+		ctx:        ctx,
+		client:     client,
+		collectors: make([]prometheus.Collector, 0),
+		minAge:     minAge,
+		lock:       &sync.Mutex{},
+	}
+}
+
+// Add registers a metric populated by the Client's event handlers; it is collected after the data is refreshed
+func (sc *ScrapeCollector) Add(collector prometheus.Collector) {
+	sc.collectors = append(sc.collectors, collector)
+}
+
+func (sc *ScrapeCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range sc.collectors {
+		collector.Describe(ch)
+	}
+}
+
+// Refresh fetches every data source concurrently, unless the data is younger than minAge; ctx (the scrape's deadline) bounds the requests.
+// Concurrent scrapes wait for the refresh in progress and share its data.
+func (sc *ScrapeCollector) Refresh(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(sc.ctx, cancel)
+	defer stop()
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	// While the circuit breaker is open the last data is served; the stale policy applies to it
+	if time.Since(sc.lastFetch) < sc.minAge || !sc.client.breaker.allow() {
+		return
+	}
+	dataSources := sc.client.dataSources
+	if !sc.client.State().Snapshot().Loaded(state.RESOURCE_REGISTRY_TEMPLATES) {
+		// instances are named after the templates, so these are needed first
+		dataSources = []DataSource{}
+		for _, dataSource := range sc.client.dataSources {
+			if dataSource.Event == events.EVENT_REGISTRY_TEMPLATES_UPDATED {
+				sc.refresh(ctx, dataSource)
+			} else {
+				dataSources = append(dataSources, dataSource)
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	for _, dataSource := range dataSources {
+		wg.Add(1)
+		go func(dataSource DataSource) {
+			defer wg.Done()
+			sc.refresh(ctx, dataSource)
+		}(dataSource)
+	}
+	wg.Wait()
+	sc.lastFetch = time.Now()
+}
+
+func (sc *ScrapeCollector) refresh(ctx context.Context, dataSource DataSource) {
+	if err := sc.client.refresh(ctx, dataSource); err != nil {
+		log.Error(fmt.Sprintf("[controller::%s] could not get data: %+v", sc.client.name, err))
+		if ctx.Err() == nil {
+			sc.client.breaker.failure(sc.ctx)
+		}
+		return
+	}
+	sc.client.breaker.success()
+}
+
+// Collect refreshes the data if the scrape didn't (when the registry is served by another handler), then holds the lock while collecting
+// so a scrape never sees values from two different fetches
+func (sc *ScrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	sc.Refresh(sc.ctx)
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	for _, collector := range sc.collectors {
+		collector.Collect(ch)
+	}
+}
@@ -1,74 +1,179 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/veertuinc/anka-prometheus-exporter/src/events"
 	"github.com/veertuinc/anka-prometheus-exporter/src/log"
 	"github.com/veertuinc/anka-prometheus-exporter/src/state"
 	"github.com/veertuinc/anka-prometheus-exporter/src/types"
 )
 
-var lock = &sync.Mutex{}
-var updateLock = &sync.Mutex{}
-
 type Communicator struct {
 	controllerAddress string
 	username          string
 	password          string
 	uak               UAK
-	encodedTAPData    string
+	encodedTAPData    string // the UAK session; guarded by tokenLock since every endpoint reads it
+	httpClient        *http.Client
+	state             *state.State
+	metrics           *communicatorMetrics
+	endpointLocks     map[string]*sync.Mutex // serializes the requests of each data source, so a slow endpoint doesn't hold back the others
+	requestSlots      chan struct{}          // caps the requests in flight to the Controller
+	tokenLock         *sync.RWMutex
+	updateLock        *sync.Mutex // held while the UAK session is renewed
 }
 
-func (comm *Communicator) UpdateEncodedTAPData() error {
-	var err error
-	if updateLock.TryLock() {
-		defer updateLock.Unlock()
-		if err = comm.TestConnection(); err.Error() == "Authentication Required" {
-			data, err := setUpUAK(comm.uak, comm.controllerAddress)
-			if err != nil {
-				return err
-			}
-			comm.encodedTAPData = data
-			err = nil
-		}
-		if err = comm.TestConnection(); err != nil {
+func (comm *Communicator) token() string {
+	comm.tokenLock.RLock()
+	defer comm.tokenLock.RUnlock()
+	return comm.encodedTAPData
+}
+
+func (comm *Communicator) UpdateEncodedTAPData(ctx context.Context) error {
+	return comm.renewSession(ctx, comm.token())
+}
+
+// renewSession obtains a new UAK session unless the stale one was already replaced: requests failing together wait for a single renewal
+func (comm *Communicator) renewSession(ctx context.Context, stale string) error {
+	comm.updateLock.Lock()
+	defer comm.updateLock.Unlock()
+	if comm.token() != stale {
+		return nil
+	}
+	err := comm.TestConnection(ctx)
+	if err != nil && err.Error() == "Authentication Required" {
+		data, err := setUpUAK(ctx, comm.httpClient, comm.uak, comm.controllerAddress)
+		if err != nil {
+			comm.metrics.uakRenewals.WithLabelValues("failure").Inc()
 			return err
 		}
-		log.Info("[auth::uak] obtained new UAK session")
+		comm.tokenLock.Lock()
+		comm.encodedTAPData = data
+		comm.tokenLock.Unlock()
+	}
+	if err = comm.TestConnection(ctx); err != nil {
+		comm.metrics.uakRenewals.WithLabelValues("failure").Inc()
+		return err
 	}
-	return err
+	comm.metrics.uakRenewals.WithLabelValues("success").Inc()
+	log.Info("[auth::uak] obtained new UAK session")
+	return nil
 }
 
-func NewCommunicator(addr, username, password string, certs ClientTLSCerts, uak UAK) (*Communicator, error) {
+// NewCommunicator makes no request to the Controller; call Connect to obtain the UAK session up front
+func NewCommunicator(addr, username, password string, certs ClientTLSCerts, httpOptions HTTPOptions, uak UAK) (*Communicator, error) {
+	httpClient, err := newHTTPClient(certs, httpOptions)
+	if err != nil {
+		return nil, err
+	}
+
 	comm := &Communicator{
 		controllerAddress: addr,
 		username:          username,
 		password:          password,
 		uak:               uak,
-	}
-
-	if err := setUpTLS(certs); err != nil {
-		return nil, err
+		httpClient:        httpClient,
+		state:             state.NewState(),
+		metrics:           newCommunicatorMetrics(),
+		endpointLocks: map[string]*sync.Mutex{
+			"/api/v1/status":        {},
+			"/api/v1/node":          {},
+			"/api/v1/group":         {},
+			"/api/v1/vm":            {},
+			"/api/v1/registry/disk": {},
+			"/api/v1/registry/vm":   {},
+		},
+		requestSlots: make(chan struct{}, httpOptions.withDefaults().MaxConcurrent),
+		tokenLock:    &sync.RWMutex{},
+		updateLock:   &sync.Mutex{},
 	}
 
 	if uak.ID != "" {
 		log.Info(fmt.Sprintf("[auth::uak] Using User API Key | ID: %s", uak.ID))
-		if err := comm.UpdateEncodedTAPData(); err != nil {
-			return nil, err
-		}
 	}
 
 	return comm, nil
 }
 
-func (comm *Communicator) TestConnection() error {
+// Connect obtains a UAK session when a UAK is configured. Failures are only logged: the session is also renewed by the first request
+// answered with "Authentication Required", so an unreachable Controller isn't fatal.
+func (comm *Communicator) Connect(ctx context.Context) {
+	if comm.uak.ID == "" {
+		return
+	}
+	if err := comm.UpdateEncodedTAPData(ctx); err != nil && ctx.Err() == nil {
+		log.Error(fmt.Sprintf("[auth::uak] could not obtain a UAK session (retrying with the next request): %+v", err))
+	}
+}
+
+// State returns the snapshots of the Controller resources fetched by the Communicator
+func (comm *Communicator) State() *state.State {
+	return comm.state
+}
+
+// CloseIdleConnections closes the idle connections to the Controller, for a Communicator that is no longer used
+func (comm *Communicator) CloseIdleConnections() {
+	comm.httpClient.CloseIdleConnections()
+}
+
+// Collectors returns the metrics instrumenting the requests made to the Controller
+func (comm *Communicator) Collectors() []prometheus.Collector {
+	return comm.metrics.collectors()
+}
+
+type DataSource struct {
+	Name  string
+	Event events.Event
+	// Refresh fetches the data from the Controller and publishes it to the event's topic
+	Refresh func(ctx context.Context) error
+}
+
+// DataSources lists every Controller endpoint we collect and the topic of the bus its data is published to.
+// Order matters here since GetVmsData relies on the templates data stored by GetRegistryTemplatesData
+func (comm *Communicator) DataSources(bus *events.Bus) []DataSource {
+	return []DataSource{
+		newDataSource(comm.GetRegistryTemplatesData, bus.RegistryTemplates),
+		newDataSource(comm.GetStatus, bus.Status),
+		newDataSource(comm.GetNodesData, bus.Nodes),
+		newDataSource(comm.GetGroupsData, bus.Groups),
+		newDataSource(comm.GetVmsData, bus.Instances),
+		newDataSource(comm.GetRegistryDiskData, bus.RegistryDisk),
+	}
+}
+
+func newDataSource[T any](fetch func(context.Context) (T, error), topic *events.Topic[T]) DataSource {
+	return DataSource{
+		Name:  topic.Event().String(),
+		Event: topic.Event(),
+		Refresh: func(ctx context.Context) error {
+			data, err := fetch(ctx)
+			if err != nil {
+				return err
+			}
+			topic.Publish(data)
+			return nil
+		},
+	}
+}
+
+func (comm *Communicator) TestConnection(ctx context.Context) error {
 	endpoint := "/api/v1/status"
-	r, err := comm.getResponse(endpoint, comm.username, comm.password)
+	release, err := comm.acquireRequestSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	r, err := comm.getResponse(ctx, endpoint, comm.username, comm.password)
 	if err != nil {
 		return err
 	}
@@ -89,41 +194,53 @@ func (comm *Communicator) TestConnection() error {
 	}
 }
 
-func (comm *Communicator) GetStatus() (interface{}, error) {
-	lock.Lock()
-	defer lock.Unlock()
+func (comm *Communicator) GetStatus(ctx context.Context) (types.Status, error) {
 	endpoint := "/api/v1/status"
+	comm.endpointLocks[endpoint].Lock()
+	defer comm.endpointLocks[endpoint].Unlock()
 	resp := &types.StatusResponse{}
-	d, err := comm.getData(endpoint, resp)
-	if err != nil {
-		return nil, fmt.Errorf("getting status error: %s", err)
+	if err := comm.getData(ctx, endpoint, resp); err != nil {
+		return types.Status{}, fmt.Errorf("getting status error: %s", err)
 	}
-	return d, nil
+	comm.state.SetStatus(resp.Body)
+	return resp.Body, nil
 }
 
-func (comm *Communicator) GetNodesData() (interface{}, error) {
-	lock.Lock()
-	defer lock.Unlock()
+func (comm *Communicator) GetNodesData(ctx context.Context) ([]types.Node, error) {
 	endpoint := "/api/v1/node"
+	comm.endpointLocks[endpoint].Lock()
+	defer comm.endpointLocks[endpoint].Unlock()
 	resp := &types.NodesResponse{}
-	d, err := comm.getData(endpoint, resp)
-	if err != nil {
+	if err := comm.getData(ctx, endpoint, resp); err != nil {
 		return nil, fmt.Errorf("getting node data error: %s", err)
 	}
-	return d, nil
+	comm.state.SetNodes(resp.Body)
+	return resp.Body, nil
 }
 
-func (comm *Communicator) GetVmsData() (interface{}, error) {
-	lock.Lock()
-	defer lock.Unlock()
+// GetGroupsData lists every group defined on the Controller, including the ones without Nodes
+func (comm *Communicator) GetGroupsData(ctx context.Context) ([]types.NodeGroup, error) {
+	endpoint := "/api/v1/group"
+	comm.endpointLocks[endpoint].Lock()
+	defer comm.endpointLocks[endpoint].Unlock()
+	resp := &types.GroupsResponse{}
+	if err := comm.getData(ctx, endpoint, resp); err != nil {
+		return nil, fmt.Errorf("getting groups data error: %s", err)
+	}
+	comm.state.SetGroups(resp.Body)
+	return resp.Body, nil
+}
+
+func (comm *Communicator) GetVmsData(ctx context.Context) ([]types.Instance, error) {
 	endpoint := "/api/v1/vm"
+	comm.endpointLocks[endpoint].Lock()
+	defer comm.endpointLocks[endpoint].Unlock()
 	resp := &types.InstancesResponse{}
-	d, err := comm.getData(endpoint, resp)
-	if err != nil {
+	if err := comm.getData(ctx, endpoint, resp); err != nil {
 		return nil, fmt.Errorf("getting vms data error: %s", err)
 	}
-	templatesMap := state.GetState().GetTemplatesMap()
-	instances := d.([]types.Instance)
+	templatesMap := comm.state.Snapshot().Templates
+	instances := resp.Body
 	for i, v := range instances {
 		template, ok := templatesMap[v.Vm.TemplateUUID]
 		if !ok {
@@ -131,109 +248,202 @@ func (comm *Communicator) GetVmsData() (interface{}, error) {
 		}
 		instances[i].Vm.TemplateName = template.Name
 	}
+	comm.state.SetInstances(instances)
 	return instances, nil
 }
 
-func (comm *Communicator) GetRegistryDiskData() (interface{}, error) {
-	lock.Lock()
-	defer lock.Unlock()
+func (comm *Communicator) GetRegistryDiskData(ctx context.Context) (types.RegistryDisk, error) {
 	endpoint := "/api/v1/registry/disk"
+	comm.endpointLocks[endpoint].Lock()
+	defer comm.endpointLocks[endpoint].Unlock()
 	resp := &types.RegistryDiskResponse{}
-	d, err := comm.getData(endpoint, resp)
-	if err != nil {
-		return nil, fmt.Errorf("getting registry disk data error: %s", err)
+	if err := comm.getData(ctx, endpoint, resp); err != nil {
+		return types.RegistryDisk{}, fmt.Errorf("getting registry disk data error: %s", err)
 	}
-	return d, nil
+	comm.state.SetRegistryDisk(resp.Body)
+	return resp.Body, nil
 }
 
-func (comm *Communicator) GetRegistryTemplatesData() (interface{}, error) {
-	lock.Lock()
-	defer lock.Unlock()
+func (comm *Communicator) GetRegistryTemplatesData(ctx context.Context) ([]types.Template, error) {
 	endpoint := "/api/v1/registry/vm"
+	comm.endpointLocks[endpoint].Lock()
+	defer comm.endpointLocks[endpoint].Unlock()
 	resp := &types.RegistryTemplateResponse{}
-	templates, err := comm.getData(endpoint, resp)
-	if err != nil {
+	if err := comm.getData(ctx, endpoint, resp); err != nil {
 		return nil, fmt.Errorf("getting registry templates error: %s", err.Error())
 	}
-	templatesArray := templates.([]types.Template)
-	templatesMap := state.GetState().GetTemplatesMap()
-	for i, template := range templatesArray {
-		if templatesMap[template.UUID].Size != template.Size {
-			endpoint := "/api/v1/registry/vm?id=" + template.UUID
-			resp := &types.RegistryTemplateTagsResponse{}
-			tagsData, err := comm.getData(endpoint, resp)
-			if err != nil {
-				return nil, fmt.Errorf("getting registry template %s/%s tags error: %s", template.UUID, template.Name, err.Error())
+	templatesArray := resp.Body
+	templatesMap := comm.state.Snapshot().Templates
+
+	// Tags are only requested for new templates and templates whose size changed (pushing or deleting a tag changes it)
+	outdated := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < comm.tagWorkers(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range outdated {
+				template := &templatesArray[i]
+				tags, err := comm.getTemplateTags(ctx, template.UUID)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Error(fmt.Sprintf("getting registry template %s/%s tags error (keeping the previous tags): %s", template.UUID, template.Name, err.Error()))
+					}
+					// keep the previous size so the tags are requested again on the next refresh
+					template.Size = templatesMap[template.UUID].Size
+					template.Tags = templatesMap[template.UUID].Tags
+					continue
+				}
+				template.Tags = tags
 			}
-			tags := tagsData.(types.RegistryTemplateTags)
-			templatesArray[i].Tags = tags.Versions
-		} else {
-			templatesArray[i].Tags = templatesMap[template.UUID].Tags
+		}()
+	}
+	for i, template := range templatesArray {
+		cached, ok := templatesMap[template.UUID]
+		if ok && cached.Size == template.Size {
+			templatesArray[i].Tags = cached.Tags
+			continue
 		}
+		select {
+		case outdated <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(outdated)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	added, removed := comm.state.SetTemplates(templatesArray)
+	comm.metrics.registryTemplateChanges.WithLabelValues("added").Add(float64(len(added)))
+	comm.metrics.registryTemplateChanges.WithLabelValues("removed").Add(float64(len(removed)))
+	if len(removed) > 0 {
+		log.Debug(fmt.Sprintf("registry templates removed: %v", removed))
 	}
-	state.GetState().SetTemplatesMap(templatesArray)
 	return templatesArray, nil
 }
 
-func (comm *Communicator) fetchResponseData(endpoint string, repsObject types.Response) (types.Response, error) {
-	r, err := comm.getResponse(endpoint, comm.username, comm.password)
+func (comm *Communicator) getTemplateTags(ctx context.Context, uuid string) ([]types.TemplateTag, error) {
+	resp := &types.RegistryTemplateTagsResponse{}
+	if err := comm.getData(ctx, "/api/v1/registry/vm?id="+uuid, resp); err != nil {
+		return nil, err
+	}
+	return resp.Body.Versions, nil
+}
+
+// tagWorkers leaves half of the request slots to the other endpoints while the tags of many templates are requested
+func (comm *Communicator) tagWorkers() int {
+	return max(1, cap(comm.requestSlots)/2)
+}
+
+func (comm *Communicator) fetchResponseData(ctx context.Context, endpoint string, repsObject types.Response) (types.Response, error) {
+	release, err := comm.acquireRequestSlot(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer release()
+	start := time.Now()
+	r, err := comm.getResponse(ctx, endpoint, comm.username, comm.password)
+	if err != nil {
+		if ctx.Err() == nil {
+			comm.metrics.observeError(endpoint, ERROR_CLASS_TRANSPORT)
+		}
+		return nil, err
+	}
 	defer r.Body.Close()
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
+		comm.metrics.observeError(endpoint, ERROR_CLASS_TRANSPORT)
 		return nil, err
 	}
+	comm.metrics.observeRequest(endpoint, time.Since(start), len(body))
 	if err = json.Unmarshal(body, &repsObject); err != nil {
+		if r.StatusCode >= http.StatusBadRequest {
+			comm.metrics.observeError(endpoint, ERROR_CLASS_HTTP_STATUS)
+			return nil, fmt.Errorf("%s returned status code %d", endpoint, r.StatusCode)
+		}
+		comm.metrics.observeError(endpoint, ERROR_CLASS_JSON_DECODE)
 		return nil, err
 	}
+	if repsObject.GetStatus() != "OK" {
+		switch {
+		case repsObject.GetMessage() == "Authentication Required" || r.StatusCode == http.StatusUnauthorized || r.StatusCode == http.StatusForbidden:
+			comm.metrics.observeError(endpoint, ERROR_CLASS_AUTH)
+		case r.StatusCode >= http.StatusBadRequest:
+			comm.metrics.observeError(endpoint, ERROR_CLASS_HTTP_STATUS)
+		default:
+			comm.metrics.observeError(endpoint, ERROR_CLASS_API)
+		}
+	}
 	return repsObject, nil
 }
 
-func (comm *Communicator) getData(endpoint string, repsObject types.Response) (interface{}, error) {
+// getData fills repsObject with the response of the endpoint, renewing the UAK session if needed
+func (comm *Communicator) getData(ctx context.Context, endpoint string, repsObject types.Response) error {
 
-	repsObject, err := comm.fetchResponseData(endpoint, repsObject)
+	session := comm.token()
+	repsObject, err := comm.fetchResponseData(ctx, endpoint, repsObject)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	retryCount := 2
 	for repsObject.GetStatus() != "OK" && retryCount < 4 {
 		if comm.uak.ID != "" && repsObject.GetMessage() == "Authentication Required" {
 			log.Warn("[auth::uak] uak session expired")
-			err = comm.UpdateEncodedTAPData()
+			err = comm.renewSession(ctx, session)
 			if err != nil {
 				log.Error(fmt.Sprintf("could not renew TAP for UAK: %+v", err))
 			}
-			repsObject, err = comm.fetchResponseData(endpoint, repsObject)
+			session = comm.token()
+			repsObject, err = comm.fetchResponseData(ctx, endpoint, repsObject)
 			if err != nil {
 				log.Error(fmt.Sprintf("could not get data (after TAP renewal): %+v", err))
+				break
 			}
 		} else {
-			return nil, errors.New(repsObject.GetMessage())
+			return errors.New(repsObject.GetMessage())
 		}
 		retryCount++
 	}
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if repsObject.GetStatus() != "OK" {
+		return errors.New(repsObject.GetMessage())
+	}
+	comm.metrics.observeSuccess(endpoint)
+	return nil
+}
+
+// acquireRequestSlot waits for one of the request slots, so no more than MaxConcurrent requests are in flight to the Controller
+func (comm *Communicator) acquireRequestSlot(ctx context.Context) (func(), error) {
+	select {
+	case comm.requestSlots <- struct{}{}:
+		comm.metrics.requestsInFlight.Inc()
+		return func() {
+			comm.metrics.requestsInFlight.Dec()
+			<-comm.requestSlots
+		}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	return repsObject.GetBody(), nil
 }
 
-func (comm *Communicator) getResponse(endpoint, username, password string) (*http.Response, error) {
+func (comm *Communicator) getResponse(ctx context.Context, endpoint, username, password string) (*http.Response, error) {
 	url := fmt.Sprintf("%s%s", comm.controllerAddress, endpoint)
-	req, err := http.NewRequest("GET", url, http.NoBody)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, http.NoBody)
 	if err != nil {
 		return nil, err
 	}
 	// set auth
 	if username != "" && password != "" {
 		req.SetBasicAuth(username, password)
-	} else if comm.encodedTAPData != "" {
-		req.Header.Set("Authorization", "Bearer "+comm.encodedTAPData)
+	} else if token := comm.token(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
 	}
-	r, err := http.DefaultClient.Do(req)
+	r, err := comm.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
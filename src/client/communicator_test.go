@@ -0,0 +1,98 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
+// fakeRegistry serves the registry template listing and the tags of every template, recording which tags were requested
+type fakeRegistry struct {
+	templates []types.Template
+	requested []string
+	lock      *sync.Mutex
+}
+
+func (fr *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	if id := r.URL.Query().Get("id"); id != "" {
+		fr.requested = append(fr.requested, id)
+		json.NewEncoder(w).Encode(map[string]any{"status": "OK", "body": map[string]any{"versions": []map[string]any{{"tag": "v1"}}}})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"status": "OK", "body": fr.templates})
+}
+
+func TestRegistryTemplateChanges(t *testing.T) {
+	registry := &fakeRegistry{lock: &sync.Mutex{}}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	comm, err := NewCommunicator(server.URL, "", "", ClientTLSCerts{}, HTTPOptions{}, UAK{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		name      string
+		templates []types.Template
+		added     float64 // since the first listing
+		removed   float64
+		requested []string // templates whose tags are requested
+	}{
+		{
+			name:      "first listing",
+			templates: []types.Template{{UUID: "t1", Size: 1}, {UUID: "t2", Size: 1}},
+			requested: []string{"t1", "t2"},
+		},
+		{
+			name:      "unchanged",
+			templates: []types.Template{{UUID: "t1", Size: 1}, {UUID: "t2", Size: 1}},
+		},
+		{
+			name:      "added and resized",
+			templates: []types.Template{{UUID: "t1", Size: 2}, {UUID: "t2", Size: 1}, {UUID: "t3", Size: 1}},
+			added:     1,
+			requested: []string{"t1", "t3"},
+		},
+		{
+			name:      "removed",
+			templates: []types.Template{{UUID: "t3", Size: 1}},
+			added:     1,
+			removed:   2,
+		},
+	}
+	for _, step := range steps {
+		registry.lock.Lock()
+		registry.templates = step.templates
+		registry.requested = nil
+		registry.lock.Unlock()
+		templates, err := comm.GetRegistryTemplatesData(context.Background())
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		for _, template := range templates {
+			if len(template.Tags) != 1 {
+				t.Errorf("%s: template %s has tags %v, expected v1", step.name, template.UUID, template.Tags)
+			}
+		}
+		slices.Sort(registry.requested)
+		if !slices.Equal(registry.requested, step.requested) {
+			t.Errorf("%s: tags requested for %v, expected %v", step.name, registry.requested, step.requested)
+		}
+		added := testutil.ToFloat64(comm.metrics.registryTemplateChanges.WithLabelValues("added"))
+		removed := testutil.ToFloat64(comm.metrics.registryTemplateChanges.WithLabelValues("removed"))
+		if added != step.added || removed != step.removed {
+			t.Errorf("%s: %v added and %v removed, expected %v and %v", step.name, added, removed, step.added, step.removed)
+		}
+		if uuids := len(comm.State().Snapshot().Templates); uuids != len(step.templates) {
+			t.Errorf("%s: %d templates in state, expected %d", step.name, uuids, len(step.templates))
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package client
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/veertuinc/anka-prometheus-exporter/src/events"
+)
+
+const (
+	STALE_POLICY_KEEP = "keep" // keep serving the last values (default)
+	STALE_POLICY_DROP = "drop" // stop serving the series of the failing source
+	STALE_POLICY_MARK = "mark" // keep the series but serve NaN as the value of gauges; counters and histograms keep their last values
+)
+
+var (
+	sourceUpDesc = prometheus.NewDesc(
+		"anka_exporter_source_up",
+		"Whether the last request for the data source succeeded (label: source)",
+		[]string{"source"}, nil,
+	)
+	sourceDataAgeDesc = prometheus.NewDesc(
+		"anka_exporter_source_data_age_seconds",
+		"Seconds since the data source was last fetched successfully (label: source)",
+		[]string{"source"}, nil,
+	)
+)
+
+// sourceHealth tracks the outcome of the latest request of each data source
+type sourceHealth struct {
+	up           map[string]bool
+	firstAttempt map[string]time.Time
+	lastSuccess  map[string]time.Time
+	lock         *sync.Mutex
+}
+
+func newSourceHealth() *sourceHealth {
+	return &sourceHealth{
+		up:           make(map[string]bool),
+		firstAttempt: make(map[string]time.Time),
+		lastSuccess:  make(map[string]time.Time),
+		lock:         &sync.Mutex{},
+	}
+}
+
+func (sh *sourceHealth) observe(source string, err error) {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	sh.up[source] = err == nil
+	if _, ok := sh.firstAttempt[source]; !ok {
+		sh.firstAttempt[source] = time.Now()
+	}
+	if err == nil {
+		sh.lastSuccess[source] = time.Now()
+	}
+}
+
+// failingFor returns how long the source has been failing: since its last success, or since its first request if it never succeeded;
+// zero if its last request succeeded or it wasn't requested yet
+func (sh *sourceHealth) failingFor(source string) time.Duration {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	if sh.up[source] {
+		return 0
+	}
+	if lastSuccess, ok := sh.lastSuccess[source]; ok {
+		return time.Since(lastSuccess)
+	}
+	if firstAttempt, ok := sh.firstAttempt[source]; ok {
+		return time.Since(firstAttempt)
+	}
+	return 0
+}
+
+func ValidateStalePolicy(policy string) error {
+	switch policy {
+	case STALE_POLICY_KEEP, STALE_POLICY_DROP, STALE_POLICY_MARK:
+		return nil
+	}
+	return fmt.Errorf("unknown stale policy %s (expected %s, %s or %s)", policy, STALE_POLICY_KEEP, STALE_POLICY_DROP, STALE_POLICY_MARK)
+}
+
+// SetStalePolicy configures what happens to the series of a data source that has been failing for longer than intervals * the polling interval
+func (client *Client) SetStalePolicy(policy string, intervals int) {
+	client.stalePolicy = policy
+	client.staleIntervals = intervals
+}
+
+func (client *Client) isStale(ev events.Event) bool {
+	if client.stalePolicy == STALE_POLICY_KEEP || client.stalePolicy == "" {
+		return false
+	}
+	for _, dataSource := range client.dataSources {
+		if dataSource.Event == ev {
+			threshold := time.Duration(client.staleIntervals) * client.interval(dataSource.Name)
+			failingFor := client.health.failingFor(dataSource.Name)
+			return failingFor > 0 && failingFor > threshold
+		}
+	}
+	return false
+}
+
+// HealthCollector exposes the up and data age gauges of every data source
+func (client *Client) HealthCollector() prometheus.Collector {
+	return &healthCollector{client: client}
+}
+
+type healthCollector struct {
+	client *Client
+}
+
+func (hc *healthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sourceUpDesc
+	ch <- sourceDataAgeDesc
+}
+
+func (hc *healthCollector) Collect(ch chan<- prometheus.Metric) {
+	health := hc.client.health
+	health.lock.Lock()
+	defer health.lock.Unlock()
+	for _, dataSource := range hc.client.dataSources {
+		up := 0.0
+		if health.up[dataSource.Name] {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(sourceUpDesc, prometheus.GaugeValue, up, dataSource.Name)
+		if lastSuccess, ok := health.lastSuccess[dataSource.Name]; ok {
+			ch <- prometheus.MustNewConstMetric(sourceDataAgeDesc, prometheus.GaugeValue, time.Since(lastSuccess).Seconds(), dataSource.Name)
+		}
+	}
+}
+
+// WrapCollector applies the stale policy to a metric populated from the given event
+func (client *Client) WrapCollector(ev events.Event, collector prometheus.Collector) prometheus.Collector {
+	return &staleAwareCollector{client: client, event: ev, collector: collector}
+}
+
+type staleAwareCollector struct {
+	client    *Client
+	event     events.Event
+	collector prometheus.Collector
+}
+
+func (sac *staleAwareCollector) Describe(ch chan<- *prometheus.Desc) {
+	sac.collector.Describe(ch)
+}
+
+func (sac *staleAwareCollector) Collect(ch chan<- prometheus.Metric) {
+	if !sac.client.isStale(sac.event) {
+		sac.collector.Collect(ch)
+		return
+	}
+	if sac.client.stalePolicy == STALE_POLICY_DROP {
+		return
+	}
+	inner := make(chan prometheus.Metric)
+	go func() {
+		sac.collector.Collect(inner)
+		close(inner)
+	}()
+	for metric := range inner {
+		ch <- nanMetric{metric}
+	}
+}
+
+// nanMetric keeps the identity of a gauge or untyped series but replaces its value with NaN.
+// Counters and histograms are written unchanged: NaN would break rate() and the buckets can't be marked, so they keep their last values.
+type nanMetric struct {
+	prometheus.Metric
+}
+
+func (nm nanMetric) Write(out *dto.Metric) error {
+	if err := nm.Metric.Write(out); err != nil {
+		return err
+	}
+	nan := math.NaN()
+	if out.Gauge != nil {
+		out.Gauge.Value = &nan
+	}
+	if out.Untyped != nil {
+		out.Untyped.Value = &nan
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestFailingFor(t *testing.T) {
+	tests := []struct {
+		name         string
+		up           bool
+		firstAttempt time.Duration // ago; zero when never requested
+		lastSuccess  time.Duration // ago; zero when it never succeeded
+		failingFor   time.Duration // approximately
+	}{
+		{name: "never requested"},
+		{name: "up", up: true, firstAttempt: time.Hour, lastSuccess: time.Second},
+		{name: "failing since a success", firstAttempt: time.Hour, lastSuccess: time.Minute, failingFor: time.Minute},
+		{name: "never succeeded", firstAttempt: 10 * time.Minute, failingFor: 10 * time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sh := newSourceHealth()
+			sh.up["nodes"] = test.up
+			if test.firstAttempt > 0 {
+				sh.firstAttempt["nodes"] = time.Now().Add(-test.firstAttempt)
+			}
+			if test.lastSuccess > 0 {
+				sh.lastSuccess["nodes"] = time.Now().Add(-test.lastSuccess)
+			}
+			if failingFor := sh.failingFor("nodes"); failingFor < test.failingFor || failingFor > test.failingFor+time.Second {
+				t.Errorf("failingFor() = %s, expected %s", failingFor, test.failingFor)
+			}
+		})
+	}
+}
+
+func TestObserveFirstAttempt(t *testing.T) {
+	sh := newSourceHealth()
+	sh.observe("nodes", errors.New("connection refused"))
+	first := sh.firstAttempt["nodes"]
+	if first.IsZero() || sh.failingFor("nodes") <= 0 {
+		t.Fatalf("a source failing since its first request is not failing (first attempt %s)", first)
+	}
+	sh.observe("nodes", errors.New("connection refused"))
+	if !sh.firstAttempt["nodes"].Equal(first) {
+		t.Errorf("first attempt moved from %s to %s", first, sh.firstAttempt["nodes"])
+	}
+	sh.observe("nodes", nil)
+	if failingFor := sh.failingFor("nodes"); failingFor != 0 {
+		t.Errorf("failingFor() = %s after a success, expected 0", failingFor)
+	}
+}
+
+// The mark policy only replaces the values of gauges and untyped series
+func TestNanMetric(t *testing.T) {
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "histogram", Buckets: []float64{1}})
+	histogram.Observe(0.5)
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "counter"})
+	counter.Add(3)
+	tests := []struct {
+		name   string
+		metric prometheus.Metric
+		value  func(*dto.Metric) float64
+		nan    bool
+	}{
+		{
+			name:   "gauge",
+			metric: prometheus.MustNewConstMetric(prometheus.NewDesc("gauge", "", nil, nil), prometheus.GaugeValue, 2),
+			value:  func(m *dto.Metric) float64 { return m.GetGauge().GetValue() },
+			nan:    true,
+		},
+		{
+			name:   "untyped",
+			metric: prometheus.MustNewConstMetric(prometheus.NewDesc("untyped", "", nil, nil), prometheus.UntypedValue, 2),
+			value:  func(m *dto.Metric) float64 { return m.GetUntyped().GetValue() },
+			nan:    true,
+		},
+		{
+			name:   "counter",
+			metric: counter,
+			value:  func(m *dto.Metric) float64 { return m.GetCounter().GetValue() },
+		},
+		{
+			name:   "histogram",
+			metric: histogram,
+			value:  func(m *dto.Metric) float64 { return m.GetHistogram().GetSampleSum() },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := &dto.Metric{}
+			if err := (nanMetric{test.metric}).Write(out); err != nil {
+				t.Fatal(err)
+			}
+			if value := test.value(out); math.IsNaN(value) != test.nan {
+				t.Errorf("value = %v, expected NaN: %t", value, test.nan)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	DEFAULT_CONNECT_TIMEOUT_SECONDS       = 5
+	DEFAULT_TLS_HANDSHAKE_TIMEOUT_SECONDS = 5
+	DEFAULT_REQUEST_TIMEOUT_SECONDS       = 30
+	DEFAULT_MAX_CONNECTIONS               = 10
+	DEFAULT_MAX_CONCURRENT_REQUESTS       = 4
+)
+
+// HTTPOptions bounds the requests made to a Controller so a hung Controller can't block a data loop forever
+type HTTPOptions struct {
+	ConnectTimeout      time.Duration
+	TLSHandshakeTimeout time.Duration
+	RequestTimeout      time.Duration // covers the whole request, including reading the response body
+	MaxConnections      int           // open connections to the Controller; requests above it wait for a free connection
+	MaxConcurrent       int           // requests in flight to the Controller, across every endpoint
+}
+
+func DefaultHTTPOptions() HTTPOptions {
+	return HTTPOptions{
+		ConnectTimeout:      DEFAULT_CONNECT_TIMEOUT_SECONDS * time.Second,
+		TLSHandshakeTimeout: DEFAULT_TLS_HANDSHAKE_TIMEOUT_SECONDS * time.Second,
+		RequestTimeout:      DEFAULT_REQUEST_TIMEOUT_SECONDS * time.Second,
+		MaxConnections:      DEFAULT_MAX_CONNECTIONS,
+		MaxConcurrent:       DEFAULT_MAX_CONCURRENT_REQUESTS,
+	}
+}
+
+// withDefaults replaces the unset (zero) options with the defaults
+func (options HTTPOptions) withDefaults() HTTPOptions {
+	defaults := DefaultHTTPOptions()
+	if options.ConnectTimeout <= 0 {
+		options.ConnectTimeout = defaults.ConnectTimeout
+	}
+	if options.TLSHandshakeTimeout <= 0 {
+		options.TLSHandshakeTimeout = defaults.TLSHandshakeTimeout
+	}
+	if options.RequestTimeout <= 0 {
+		options.RequestTimeout = defaults.RequestTimeout
+	}
+	if options.MaxConnections <= 0 {
+		options.MaxConnections = defaults.MaxConnections
+	}
+	if options.MaxConcurrent <= 0 {
+		options.MaxConcurrent = defaults.MaxConcurrent
+	}
+	return options
+}
+
+// Each Communicator gets its own http.Client so that controllers with different TLS settings can be monitored by the same process.
+// The UAK handshake goes through the same client, so it shares the TLS settings and timeouts.
+func newHTTPClient(certs ClientTLSCerts, options HTTPOptions) (*http.Client, error) {
+	options = options.withDefaults()
+	tlsConfig, err := setUpTLS(certs)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   options.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   options.TLSHandshakeTimeout,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          options.MaxConnections,
+		MaxIdleConnsPerHost:   options.MaxConnections,
+		MaxConnsPerHost:       options.MaxConnections,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   options.RequestTimeout,
+	}, nil
+}
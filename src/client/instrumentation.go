@@ -0,0 +1,108 @@
+package client
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	ERROR_CLASS_TRANSPORT   = "transport"
+	ERROR_CLASS_HTTP_STATUS = "http_status"
+	ERROR_CLASS_JSON_DECODE = "json_decode"
+	ERROR_CLASS_AUTH        = "auth"
+	ERROR_CLASS_API         = "api" // the controller answered with a non-OK status in the body
+)
+
+// communicatorMetrics instruments the exporter's own requests to the Controller API
+type communicatorMetrics struct {
+	requestDuration  *prometheus.HistogramVec
+	requestErrors    *prometheus.CounterVec
+	responseSize     *prometheus.HistogramVec
+	lastSuccess      *prometheus.GaugeVec
+	requestsInFlight prometheus.Gauge
+	uakRenewals      *prometheus.CounterVec
+	// templates appearing in or disappearing from the registry listing between two refreshes
+	registryTemplateChanges *prometheus.CounterVec
+}
+
+func newCommunicatorMetrics() *communicatorMetrics {
+	return &communicatorMetrics{
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "anka_exporter_controller_request_duration_seconds",
+			Help:    "Duration of requests to the Controller API (label: endpoint)",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"endpoint"}),
+		requestErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "anka_exporter_controller_request_errors_total",
+			Help: "Count of failed requests to the Controller API (label: endpoint, class)",
+		}, []string{"endpoint", "class"}),
+		responseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "anka_exporter_controller_response_size_bytes",
+			Help:    "Size of Controller API response bodies in Bytes (label: endpoint)",
+			Buckets: prometheus.ExponentialBuckets(256, 4, 9),
+		}, []string{"endpoint"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "anka_exporter_controller_last_success_timestamp_seconds",
+			Help: "Unix timestamp of the last successful request to the Controller API (label: endpoint)",
+		}, []string{"endpoint"}),
+		requestsInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "anka_exporter_controller_requests_in_flight",
+			Help: "Number of requests to the Controller API in flight",
+		}),
+		uakRenewals: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "anka_exporter_uak_session_renewals_total",
+			Help: "Count of UAK session renewals (label: result)",
+		}, []string{"result"}),
+		registryTemplateChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "anka_exporter_registry_template_changes_total",
+			Help: "Count of templates added to or removed from the Registry between two refreshes (label: change)",
+		}, []string{"change"}),
+	}
+}
+
+func (cm *communicatorMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		cm.requestDuration,
+		cm.requestErrors,
+		cm.responseSize,
+		cm.lastSuccess,
+		cm.requestsInFlight,
+		cm.uakRenewals,
+		cm.registryTemplateChanges,
+	}
+}
+
+func (cm *communicatorMetrics) observeRequest(endpoint string, duration time.Duration, size int) {
+	cm.requestDuration.WithLabelValues(endpointLabel(endpoint)).Observe(duration.Seconds())
+	cm.responseSize.WithLabelValues(endpointLabel(endpoint)).Observe(float64(size))
+}
+
+func (cm *communicatorMetrics) observeError(endpoint string, class string) {
+	cm.requestErrors.WithLabelValues(endpointLabel(endpoint), class).Inc()
+}
+
+func (cm *communicatorMetrics) observeSuccess(endpoint string) {
+	cm.lastSuccess.WithLabelValues(endpointLabel(endpoint)).SetToCurrentTime()
+}
+
+// endpointLabel drops query values (like template ids) so the endpoint label doesn't grow with every template
+func endpointLabel(endpoint string) string {
+	path, query, found := strings.Cut(endpoint, "?")
+	if !found {
+		return path
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return path
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key+"=")
+	}
+	sort.Strings(keys)
+	return path + "?" + strings.Join(keys, "&")
+}
@@ -4,7 +4,6 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
-	"net/http"
 	"os"
 )
 
@@ -28,9 +27,9 @@ func appendRootCert(certFilePath string, caCertPool *x509.CertPool) error {
 	return nil
 }
 
-func setUpTLS(certs ClientTLSCerts) error {
+func setUpTLS(certs ClientTLSCerts) (*tls.Config, error) {
 	if !certs.UseTLS {
-		return nil
+		return nil, nil
 	}
 	caCertPool, _ := x509.SystemCertPool()
 	if caCertPool == nil {
@@ -41,14 +40,14 @@ func setUpTLS(certs ClientTLSCerts) error {
 	if certs.CACert != "" {
 		err := appendRootCert(certs.CACert, caCertPool)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	if certs.Cert != "" && certs.CertKey != "" {
 		cert, err := tls.LoadX509KeyPair(certs.Cert, certs.CertKey)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		certificates = append(certificates, cert)
 	}
@@ -61,7 +60,5 @@ func setUpTLS(certs ClientTLSCerts) error {
 		tlsConfig.InsecureSkipVerify = true
 	}
 
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = tlsConfig
-	return nil
-
+	return tlsConfig, nil
 }
@@ -2,6 +2,7 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -22,15 +23,24 @@ type UAK struct {
 	KeyString string
 }
 
-func setUpUAK(uak UAK, controllerAddress string) (string, error) {
-	encodedData, err := tap(uak, controllerAddress)
+func setUpUAK(ctx context.Context, httpClient *http.Client, uak UAK, controllerAddress string) (string, error) {
+	encodedData, err := tap(ctx, httpClient, uak, controllerAddress)
 	return encodedData, err
 }
 
-func tap(uak UAK, controllerAddress string) (string, error) {
+func postJSON(ctx context.Context, httpClient *http.Client, url string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return httpClient.Do(req)
+}
+
+func tap(ctx context.Context, httpClient *http.Client, uak UAK, controllerAddress string) (string, error) {
 
 	// Send a POST request to /hand endpoint
-	resp, err := http.Post(controllerAddress+"/tap/v1/hand", "application/json", bytes.NewBuffer([]byte(`{"id": "`+uak.ID+`"}`)))
+	resp, err := postJSON(ctx, httpClient, controllerAddress+"/tap/v1/hand", bytes.NewBuffer([]byte(`{"id": "`+uak.ID+`"}`)))
 	if err != nil {
 		return "", fmt.Errorf("error while sending request to /hand endpoint: %v", err)
 	}
@@ -81,7 +91,7 @@ func tap(uak UAK, controllerAddress string) (string, error) {
 	}
 
 	// Send a POST request to /shake endpoint
-	resp, err = http.Post(controllerAddress+"/tap/v1/shake", "application/json", bytes.NewBuffer([]byte(`{"id": "`+uak.ID+`", "secret": "`+string(decryptedBody)+`"}`)))
+	resp, err = postJSON(ctx, httpClient, controllerAddress+"/tap/v1/shake", bytes.NewBuffer([]byte(`{"id": "`+uak.ID+`", "secret": "`+string(decryptedBody)+`"}`)))
 	if err != nil {
 		return "", fmt.Errorf("error while sending request to /shake endpoint: %v", err)
 	}
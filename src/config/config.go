@@ -0,0 +1,125 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/veertuinc/anka-prometheus-exporter/src/client"
+	"github.com/veertuinc/anka-prometheus-exporter/src/events"
+	"gopkg.in/yaml.v2"
+)
+
+type Config struct {
+	Controllers []Controller      `yaml:"controllers"`
+	Modules     map[string]Module `yaml:"modules"`
+}
+
+type Controller struct {
+	Name      string    `yaml:"name"`
+	Address   string    `yaml:"address"`
+	Intervals Intervals `yaml:"intervals"`
+	Module    `yaml:",inline"`
+}
+
+// Intervals overrides the polling interval (seconds) of each data source of a Controller
+type Intervals struct {
+	Status            int `yaml:"status"`
+	Nodes             int `yaml:"nodes"`
+	Groups            int `yaml:"groups"`
+	Vms               int `yaml:"vms"`
+	RegistryDisk      int `yaml:"registry_disk"`
+	RegistryTemplates int `yaml:"registry_templates"`
+}
+
+// Module holds the settings needed to talk to a Controller. Modules can be referenced by /probe requests (module=name) to apply them to any target.
+type Module struct {
+	Username string        `yaml:"username"`
+	Password string        `yaml:"password"`
+	UAK      ControllerUAK `yaml:"uak"`
+	TLS      ControllerTLS `yaml:"tls"`
+}
+
+type ControllerUAK struct {
+	ID     string `yaml:"id"`
+	Path   string `yaml:"path"`
+	String string `yaml:"string"`
+}
+
+type ControllerTLS struct {
+	Enabled          bool   `yaml:"enabled"`
+	CACert           string `yaml:"ca_cert"`
+	Cert             string `yaml:"cert"`
+	CertKey          string `yaml:"cert_key"`
+	SkipVerification bool   `yaml:"skip_verification"`
+}
+
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file %s: %w", path, err)
+	}
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate ensures every controller has an address and a unique name (the name is used as the controller label value)
+func (cfg *Config) Validate() error {
+	names := map[string]bool{}
+	for i := range cfg.Controllers {
+		controller := &cfg.Controllers[i]
+		if controller.Address == "" {
+			return fmt.Errorf("controller %d has no address", i)
+		}
+		if controller.Name == "" {
+			controller.Name = controller.Address
+		}
+		if names[controller.Name] {
+			return fmt.Errorf("controller name %s is used more than once", controller.Name)
+		}
+		names[controller.Name] = true
+	}
+	return nil
+}
+
+// FindController returns the controller with the given name or address
+func (cfg *Config) FindController(nameOrAddress string) (Controller, bool) {
+	for _, controller := range cfg.Controllers {
+		if controller.Name == nameOrAddress || controller.Address == nameOrAddress {
+			return controller, true
+		}
+	}
+	return Controller{}, false
+}
+
+// Map returns the intervals by data source name, as expected by client.SetIntervals
+func (i Intervals) Map() map[string]int {
+	return map[string]int{
+		events.EVENT_STATUS_UPDATED.String():             i.Status,
+		events.EVENT_NODE_UPDATED.String():               i.Nodes,
+		events.EVENT_GROUPS_UPDATED.String():             i.Groups,
+		events.EVENT_VM_DATA_UPDATED.String():            i.Vms,
+		events.EVENT_REGISTRY_DISK_DATA_UPDATED.String(): i.RegistryDisk,
+		events.EVENT_REGISTRY_TEMPLATES_UPDATED.String(): i.RegistryTemplates,
+	}
+}
+
+func (m Module) ClientTLSCerts() client.ClientTLSCerts {
+	return client.ClientTLSCerts{
+		UseTLS:              m.TLS.Enabled,
+		Cert:                m.TLS.Cert,
+		CertKey:             m.TLS.CertKey,
+		CACert:              m.TLS.CACert,
+		SkipTLSVerification: m.TLS.SkipVerification,
+	}
+}
+
+func (m Module) ClientUAK() client.UAK {
+	return client.UAK{
+		ID:        m.UAK.ID,
+		KeyPath:   m.UAK.Path,
+		KeyString: m.UAK.String,
+	}
+}
@@ -1,11 +1,171 @@
 package events
 
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/veertuinc/anka-prometheus-exporter/src/log"
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
 type Event int
 
 const (
-	EVENT_NODE_UPDATED               = 1
-	EVENT_REGISTRY_DISK_DATA_UPDATED = 2
-	EVENT_VM_DATA_UPDATED            = 3
-	EVENT_REGISTRY_TEMPLATES_UPDATED = 4
-	EVENT_STATUS_UPDATED             = 5
+	EVENT_NODE_UPDATED               Event = 1
+	EVENT_REGISTRY_DISK_DATA_UPDATED Event = 2
+	EVENT_VM_DATA_UPDATED            Event = 3
+	EVENT_REGISTRY_TEMPLATES_UPDATED Event = 4
+	EVENT_STATUS_UPDATED             Event = 5
+	EVENT_GROUPS_UPDATED             Event = 6
 )
+
+func (ev Event) String() string {
+	switch ev {
+	case EVENT_NODE_UPDATED:
+		return "nodes"
+	case EVENT_REGISTRY_DISK_DATA_UPDATED:
+		return "registry_disk"
+	case EVENT_VM_DATA_UPDATED:
+		return "vms"
+	case EVENT_REGISTRY_TEMPLATES_UPDATED:
+		return "registry_templates"
+	case EVENT_STATUS_UPDATED:
+		return "status"
+	case EVENT_GROUPS_UPDATED:
+		return "groups"
+	}
+	return fmt.Sprintf("event_%d", int(ev))
+}
+
+// Bus holds one typed Topic per kind of Controller data, so handlers receive their payload without type assertions
+type Bus struct {
+	Nodes             *Topic[[]types.Node]
+	RegistryDisk      *Topic[types.RegistryDisk]
+	Instances         *Topic[[]types.Instance]
+	RegistryTemplates *Topic[[]types.Template]
+	Status            *Topic[types.Status]
+	Groups            *Topic[[]types.NodeGroup]
+	metrics           *busMetrics
+}
+
+// NewBus creates the topics of a Controller; name is used in logs
+func NewBus(name string) *Bus {
+	bm := newBusMetrics()
+	return &Bus{
+		Nodes:             newTopic[[]types.Node](name, EVENT_NODE_UPDATED, bm),
+		RegistryDisk:      newTopic[types.RegistryDisk](name, EVENT_REGISTRY_DISK_DATA_UPDATED, bm),
+		Instances:         newTopic[[]types.Instance](name, EVENT_VM_DATA_UPDATED, bm),
+		RegistryTemplates: newTopic[[]types.Template](name, EVENT_REGISTRY_TEMPLATES_UPDATED, bm),
+		Status:            newTopic[types.Status](name, EVENT_STATUS_UPDATED, bm),
+		Groups:            newTopic[[]types.NodeGroup](name, EVENT_GROUPS_UPDATED, bm),
+		metrics:           bm,
+	}
+}
+
+// Collectors returns the metrics accounting for the latency and errors of every handler
+func (bus *Bus) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		bus.metrics.handlerDuration,
+		bus.metrics.handlerErrors,
+	}
+}
+
+type busMetrics struct {
+	handlerDuration *prometheus.HistogramVec
+	handlerErrors   *prometheus.CounterVec
+}
+
+func newBusMetrics() *busMetrics {
+	return &busMetrics{
+		handlerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "anka_exporter_event_handler_duration_seconds",
+			Help:    "Duration of event handlers (label: event, handler)",
+			Buckets: []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+		}, []string{"event", "handler"}),
+		handlerErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "anka_exporter_event_handler_errors_total",
+			Help: "Count of event handler failures (label: event, handler)",
+		}, []string{"event", "handler"}),
+	}
+}
+
+type Subscription interface {
+	Unsubscribe()
+}
+
+// Topic is a typed publish/subscribe channel for one kind of Controller data
+type Topic[T any] struct {
+	controller  string
+	event       Event
+	subscribers map[uint64]*subscriber[T]
+	nextID      uint64
+	lock        *sync.RWMutex
+	metrics     *busMetrics
+}
+
+type subscriber[T any] struct {
+	name    string
+	handler func(T) error
+}
+
+type subscription[T any] struct {
+	topic *Topic[T]
+	id    uint64
+}
+
+func (s subscription[T]) Unsubscribe() {
+	s.topic.lock.Lock()
+	defer s.topic.lock.Unlock()
+	delete(s.topic.subscribers, s.id)
+}
+
+func newTopic[T any](controller string, event Event, bm *busMetrics) *Topic[T] {
+	return &Topic[T]{
+		controller:  controller,
+		event:       event,
+		subscribers: make(map[uint64]*subscriber[T]),
+		lock:        &sync.RWMutex{},
+		metrics:     bm,
+	}
+}
+
+func (topic *Topic[T]) Event() Event {
+	return topic.event
+}
+
+// Subscribe adds a handler called with every published payload; name identifies the handler in logs and metrics
+func (topic *Topic[T]) Subscribe(name string, handler func(T) error) Subscription {
+	topic.lock.Lock()
+	defer topic.lock.Unlock()
+	topic.nextID++
+	topic.subscribers[topic.nextID] = &subscriber[T]{name: name, handler: handler}
+	return subscription[T]{topic: topic, id: topic.nextID}
+}
+
+// Publish runs every handler concurrently and returns once all of them are done. Failing handlers are logged and counted, never fatal.
+func (topic *Topic[T]) Publish(data T) {
+	topic.lock.RLock()
+	subscribers := make([]*subscriber[T], 0, len(topic.subscribers))
+	for _, sub := range topic.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	topic.lock.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, sub := range subscribers {
+		wg.Add(1)
+		go func(sub *subscriber[T]) {
+			defer wg.Done()
+			start := time.Now()
+			err := sub.handler(data)
+			topic.metrics.handlerDuration.WithLabelValues(topic.event.String(), sub.name).Observe(time.Since(start).Seconds())
+			if err != nil {
+				topic.metrics.handlerErrors.WithLabelValues(topic.event.String(), sub.name).Inc()
+				log.Error(fmt.Sprintf("[controller::%s] ignoring event handler failure for %s event (handler %s) - Error: %+v", topic.controller, topic.event, sub.name, err))
+			}
+		}(sub)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,361 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/veertuinc/anka-prometheus-exporter/src/checkpoint"
+	"github.com/veertuinc/anka-prometheus-exporter/src/client"
+	"github.com/veertuinc/anka-prometheus-exporter/src/config"
+	"github.com/veertuinc/anka-prometheus-exporter/src/log"
+	"github.com/veertuinc/anka-prometheus-exporter/src/metrics"
+	"github.com/veertuinc/anka-prometheus-exporter/src/probe"
+	"github.com/veertuinc/anka-prometheus-exporter/src/server"
+	"github.com/veertuinc/anka-prometheus-exporter/src/state"
+)
+
+const (
+	DEFAULT_INTERVAL_SECONDS        = 15
+	DEFAULT_COLLECT_MIN_AGE_SECONDS = 5
+	DEFAULT_STALE_INTERVALS         = 3
+	DEFAULT_SHUTDOWN_GRACE_SECONDS  = 10
+	DEFAULT_CHECKPOINT_SECONDS      = 60
+)
+
+// Options configures an Exporter; zero values fall back to the defaults of the anka-prometheus-exporter binary
+type Options struct {
+	Config                   *config.Config // Controllers to monitor and the modules available to /probe
+	IntervalSeconds          int
+	Intervals                config.Intervals // per data source intervals of every Controller; each Controller's own intervals take precedence
+	DisableIntervalOptimizer bool
+	EnableProbe              bool // serve /probe; anyone reaching the web server can then make the exporter request Controller URLs
+	CollectOnScrape          bool
+	CollectMinAgeSeconds     int
+	StalePolicy              string
+	StaleIntervals           int
+	ShutdownGraceSeconds     int                // how long Run waits for scrapes and data loops in flight once its context is done
+	HTTP                     client.HTTPOptions // timeouts and connection limits of the requests to the Controllers; zero values use client.DefaultHTTPOptions
+	Metrics                  metrics.Options    // optional metrics, such as the stuck instance thresholds
+	StateFile                string             // when set, derived counters are checkpointed to this file and restored from it by New
+	CheckpointSeconds        int                // how often the StateFile is written while running; it is also written when Run returns
+	WebListenAddress         string             // Run only serves HTTP when set; otherwise mount Handler() in your own server
+	WebConfigFile            string
+	Version                  string
+	Registry                 *prometheus.Registry // the Anka metrics are registered here; a new registry is created when nil
+}
+
+// Exporter monitors a set of Controllers. It only uses its own registry and mux, so several Exporters can run in one process.
+type Exporter struct {
+	// scrapeCtx cancels the requests made during scrapes (collect-on-scrape) once Run has drained the web server
+	scrapeCtx     context.Context
+	cancelScrapes context.CancelFunc
+	options       Options
+	registry      *prometheus.Registry
+	clients       []*client.Client
+	scrapers      []*client.ScrapeCollector           // with CollectOnScrape, refreshed before /metrics is served
+	restored      *checkpoint.Checkpoint              // loaded from StateFile by New; nil without a usable checkpoint
+	stateful      map[string][]metrics.StatefulMetric // by controller name
+	server        *server.Server
+	handler       http.Handler
+}
+
+// New registers the metrics of every Controller without making any request: Controllers are only reached once Run is called
+// (or on scrape with CollectOnScrape), each in the background so a stalled Controller never holds back the others.
+func New(options Options) (*Exporter, error) {
+	if options.Config == nil {
+		options.Config = &config.Config{}
+	}
+	if options.IntervalSeconds <= 0 {
+		options.IntervalSeconds = DEFAULT_INTERVAL_SECONDS
+	}
+	if options.CollectMinAgeSeconds <= 0 {
+		options.CollectMinAgeSeconds = DEFAULT_COLLECT_MIN_AGE_SECONDS
+	}
+	if options.StalePolicy == "" {
+		options.StalePolicy = client.STALE_POLICY_KEEP
+	}
+	if options.StaleIntervals <= 0 {
+		options.StaleIntervals = DEFAULT_STALE_INTERVALS
+	}
+	if options.ShutdownGraceSeconds <= 0 {
+		options.ShutdownGraceSeconds = DEFAULT_SHUTDOWN_GRACE_SECONDS
+	}
+	if options.CheckpointSeconds <= 0 {
+		options.CheckpointSeconds = DEFAULT_CHECKPOINT_SECONDS
+	}
+	if options.Registry == nil {
+		options.Registry = prometheus.NewRegistry()
+	}
+	if err := client.ValidateStalePolicy(options.StalePolicy); err != nil {
+		return nil, err
+	}
+	if err := options.Config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	scrapeCtx, cancelScrapes := context.WithCancel(context.Background())
+	exporter := &Exporter{
+		scrapeCtx:     scrapeCtx,
+		cancelScrapes: cancelScrapes,
+		options:       options,
+		registry:      options.Registry,
+		clients:       make([]*client.Client, 0, len(options.Config.Controllers)),
+		stateful:      make(map[string][]metrics.StatefulMetric),
+	}
+	if options.StateFile != "" {
+		restored, err := checkpoint.Load(options.StateFile)
+		if err != nil {
+			// a bad checkpoint must not keep the exporter from starting; counters start over instead
+			log.Warn(fmt.Sprintf("Skipping checkpoint: %+v", err))
+		} else if restored != nil {
+			log.Info(fmt.Sprintf("Restoring counters checkpointed at %s", restored.SavedAt.Format(time.RFC3339)))
+		}
+		exporter.restored = restored
+	}
+	for _, controller := range options.Config.Controllers {
+		if err := exporter.addController(controller); err != nil {
+			cancelScrapes()
+			return nil, err
+		}
+	}
+
+	exporter.server = server.NewServer(
+		exporter.registry,
+		options.WebListenAddress,
+		options.Version,
+		options.WebConfigFile,
+	)
+	if options.EnableProbe {
+		exporter.server.SetProbeFunc(probe.NewProber(options.Config, options.HTTP, options.Metrics).Probe)
+	}
+	if !options.DisableIntervalOptimizer && !options.CollectOnScrape {
+		exporter.server.SetIntervalUpdateFunc(func(i int64) {
+			for _, c := range exporter.clients {
+				c.UpdateInterval(i)
+			}
+		})
+	}
+	if options.CollectOnScrape {
+		exporter.server.SetScrapeFunc(exporter.refreshScrapers)
+	}
+	handler, err := exporter.server.Handler()
+	if err != nil {
+		cancelScrapes()
+		return nil, err
+	}
+	exporter.handler = handler
+	return exporter, nil
+}
+
+func (exporter *Exporter) addController(controller config.Controller) error {
+	log.Info(fmt.Sprintf("[controller::%s] Monitoring %s", controller.Name, controller.Address))
+	c, err := client.NewClient(controller.Name, controller.Address, controller.Username, controller.Password, exporter.options.IntervalSeconds, controller.ClientTLSCerts(), exporter.options.HTTP, controller.ClientUAK())
+	if err != nil {
+		return fmt.Errorf("creating client for controller %s: %w", controller.Name, err)
+	}
+
+	// Create each metric that we later populate; every controller gets its own set, stamped with the controller label
+	controllerRegistry := prometheus.WrapRegistererWith(prometheus.Labels{"controller": controller.Name}, exporter.registry)
+	if err := registerAll(controllerRegistry, c.Collectors()...); err != nil {
+		return err
+	}
+	if err := controllerRegistry.Register(c.HealthCollector()); err != nil {
+		return err
+	}
+	c.SetStalePolicy(exporter.options.StalePolicy, exporter.options.StaleIntervals)
+	if err := c.SetIntervals(exporter.options.Intervals.Map()); err != nil {
+		return err
+	}
+	if err := c.SetIntervals(controller.Intervals.Map()); err != nil {
+		return err
+	}
+	metricsOptions := exporter.options.Metrics
+	metricsOptions.Inventory = metricsOptions.Inventory.ForController(controller.Name)
+	controllerMetrics := metrics.NewMetrics(metricsOptions)
+	exporter.restore(controller.Name, controllerMetrics)
+	if exporter.options.CollectOnScrape {
+		scrapeCollector := c.NewScrapeCollector(exporter.scrapeCtx, time.Duration(exporter.options.CollectMinAgeSeconds)*time.Second)
+		for _, m := range controllerMetrics {
+			scrapeCollector.Add(c.WrapCollector(m.GetEvent(), m.GetPrometheusMetric()))
+			m.Subscribe(c.Bus())
+		}
+		if err := controllerRegistry.Register(scrapeCollector); err != nil {
+			return fmt.Errorf("registering the scrape collector for controller %s: %w", controller.Name, err)
+		}
+		exporter.scrapers = append(exporter.scrapers, scrapeCollector)
+	} else {
+		for _, m := range controllerMetrics {
+			if err := controllerRegistry.Register(c.WrapCollector(m.GetEvent(), m.GetPrometheusMetric())); err != nil {
+				return fmt.Errorf("registering %s for controller %s: %w", m.GetName(), controller.Name, err)
+			}
+			m.Subscribe(c.Bus())
+		}
+	}
+	exporter.clients = append(exporter.clients, c)
+	return nil
+}
+
+// restore keeps track of the stateful metrics of a controller and restores their checkpointed counters
+func (exporter *Exporter) restore(controllerName string, controllerMetrics []metrics.AnkaMetric) {
+	if exporter.options.StateFile == "" {
+		return
+	}
+	saved, ok := exporter.restored.Controller(controllerName)
+	for _, m := range controllerMetrics {
+		stateful, isStateful := m.(metrics.StatefulMetric)
+		if !isStateful {
+			continue
+		}
+		exporter.stateful[controllerName] = append(exporter.stateful[controllerName], stateful)
+		if !ok {
+			continue
+		}
+		if err := stateful.Restore(saved.Counters[stateful.GetName()], saved.LastSeen); err != nil {
+			log.Warn(fmt.Sprintf("[controller::%s] restoring %s: %+v", controllerName, stateful.GetName(), err))
+		}
+	}
+}
+
+// saveCheckpoint writes the derived counters and last seen resources of every controller to the StateFile
+func (exporter *Exporter) saveCheckpoint() {
+	saved := checkpoint.New()
+	for _, c := range exporter.clients {
+		controller := checkpoint.Controller{Counters: map[string][]metrics.CounterSample{}}
+		// counters first: if an update lands in between, the next start diffs against newer resources and misses it rather than counting it twice
+		for _, stateful := range exporter.stateful[c.Name()] {
+			samples, err := stateful.Checkpoint()
+			if err != nil {
+				log.Warn(fmt.Sprintf("[controller::%s] checkpointing %s: %+v", c.Name(), stateful.GetName(), err))
+				continue
+			}
+			controller.Counters[stateful.GetName()] = samples
+		}
+		snapshot := c.State().Snapshot()
+		controller.LastSeen = metrics.LastSeen{
+			Instances:       snapshot.Instances,
+			InstancesLoaded: snapshot.Loaded(state.RESOURCE_INSTANCES),
+			Nodes:           snapshot.Nodes,
+			NodesLoaded:     snapshot.Loaded(state.RESOURCE_NODES),
+		}
+		if !controller.LastSeen.InstancesLoaded && !controller.LastSeen.NodesLoaded {
+			if previous, ok := exporter.restored.Controller(c.Name()); ok {
+				// nothing fetched since the start, keep what the previous run saw
+				controller.LastSeen = previous.LastSeen
+			}
+		}
+		saved.Controllers[c.Name()] = controller
+	}
+	if err := saved.Save(exporter.options.StateFile); err != nil {
+		log.Error(fmt.Sprintf("Saving checkpoint: %+v", err))
+	}
+}
+
+func (exporter *Exporter) checkpointLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(exporter.options.CheckpointSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			exporter.saveCheckpoint()
+		}
+	}
+}
+
+// refreshScrapers refreshes every Controller concurrently, within the deadline of the scrape
+func (exporter *Exporter) refreshScrapers(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, scraper := range exporter.scrapers {
+		wg.Add(1)
+		go func(scraper *client.ScrapeCollector) {
+			defer wg.Done()
+			scraper.Refresh(ctx)
+		}(scraper)
+	}
+	wg.Wait()
+}
+
+func registerAll(registerer prometheus.Registerer, collectors ...prometheus.Collector) error {
+	for _, collector := range collectors {
+		if err := registerer.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Registry returns the registry holding the Anka metrics
+func (exporter *Exporter) Registry() *prometheus.Registry {
+	return exporter.registry
+}
+
+// State returns the snapshots of the resources of a monitored Controller, by name
+func (exporter *Exporter) State(controller string) (*state.State, bool) {
+	for _, c := range exporter.clients {
+		if c.Name() == controller {
+			return c.State(), true
+		}
+	}
+	return nil, false
+}
+
+// Handler serves /metrics, /probe and the landing page
+func (exporter *Exporter) Handler() http.Handler {
+	return exporter.handler
+}
+
+// Run starts polling the Controllers (unless CollectOnScrape is set) and, when WebListenAddress is set, serves Handler() until ctx is done.
+// It then waits up to ShutdownGraceSeconds for the scrapes and data loops in flight before returning; the Exporter can't be run again.
+func (exporter *Exporter) Run(ctx context.Context) error {
+	defer exporter.cancelScrapes()
+	gracePeriod := time.Duration(exporter.options.ShutdownGraceSeconds) * time.Second
+
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	// one deadline for the whole shutdown, so draining the web server and the data loops doesn't take twice the grace period
+	shutdownCtx, cancelShutdown := context.WithCancel(context.Background())
+	defer cancelShutdown()
+	context.AfterFunc(runCtx, func() {
+		time.AfterFunc(gracePeriod, cancelShutdown)
+	})
+	for _, c := range exporter.clients {
+		if exporter.options.CollectOnScrape {
+			c.Connect(runCtx)
+		} else {
+			c.Init(runCtx)
+		}
+	}
+	if exporter.options.StateFile != "" {
+		go exporter.checkpointLoop(runCtx)
+	}
+	var err error
+	if exporter.options.WebListenAddress == "" {
+		<-runCtx.Done()
+	} else {
+		err = exporter.server.Serve(runCtx, shutdownCtx, exporter.handler)
+	}
+
+	stop()
+	stopped := make(chan struct{})
+	go func() {
+		for _, c := range exporter.clients {
+			c.Wait()
+		}
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		log.Info("Stopped polling the Controllers")
+	case <-shutdownCtx.Done():
+		log.Warn(fmt.Sprintf("Data loops still running %s after the shutdown started, giving up on them", gracePeriod))
+	}
+	if exporter.options.StateFile != "" {
+		exporter.saveCheckpoint()
+	}
+	return err
+}
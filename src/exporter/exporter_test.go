@@ -0,0 +1,103 @@
+package exporter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/veertuinc/anka-prometheus-exporter/src/config"
+	"github.com/veertuinc/anka-prometheus-exporter/src/state"
+)
+
+// fakeController answers every endpoint polled by the exporter with an empty listing
+func fakeController() http.Handler {
+	bodies := map[string]string{
+		"/api/v1/status":        `{"status": "Running", "version": "1.0"}`,
+		"/api/v1/node":          `[]`,
+		"/api/v1/group":         `[]`,
+		"/api/v1/vm":            `[]`,
+		"/api/v1/registry/disk": `{"total": 100, "free": 50}`,
+		"/api/v1/registry/vm":   `[]`,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := bodies[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"status": "OK", "body": ` + body + `}`))
+	})
+}
+
+func TestStalledControllerDoesNotHoldBackOthers(t *testing.T) {
+	release := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer stalled.Close()
+	defer close(release) // before closing the server, which waits for the stalled requests
+	healthy := httptest.NewServer(fakeController())
+	defer healthy.Close()
+
+	start := time.Now()
+	ankaExporter, err := New(Options{
+		Config: &config.Config{Controllers: []config.Controller{
+			{Name: "stalled", Address: stalled.URL},
+			{Name: "healthy", Address: healthy.URL},
+		}},
+		IntervalSeconds:          1,
+		DisableIntervalOptimizer: true,
+		ShutdownGraceSeconds:     1,
+	})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("New() took %s with a stalled Controller", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- ankaExporter.Run(ctx) }()
+
+	healthyState, _ := ankaExporter.State("healthy")
+	deadline := time.Now().Add(5 * time.Second)
+	for !healthyState.Snapshot().Loaded(state.RESOURCE_NODES) || !healthyState.Snapshot().Loaded(state.RESOURCE_INSTANCES) {
+		if time.Now().After(deadline) {
+			t.Fatal("the healthy Controller was not polled while the other one stalled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stalledState, _ := ankaExporter.State("stalled"); stalledState.Snapshot().Loaded(state.RESOURCE_STATUS) {
+		t.Fatal("the stalled Controller has data")
+	}
+
+	scrapeStart := time.Now()
+	recorder := httptest.NewRecorder()
+	ankaExporter.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if elapsed := time.Since(scrapeStart); elapsed > time.Second {
+		t.Fatalf("/metrics took %s with a stalled Controller", elapsed)
+	}
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("/metrics returned %d", recorder.Code)
+	}
+	if body := recorder.Body.String(); !strings.Contains(body, `anka_exporter_source_up{controller="healthy",source="nodes"} 1`) {
+		t.Fatalf("/metrics doesn't report the nodes of the healthy Controller up:\n%s", body)
+	}
+
+	cancel()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("Run() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() didn't return after its context was cancelled")
+	}
+}
@@ -0,0 +1,111 @@
+package inventory
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+	"gopkg.in/yaml.v2"
+)
+
+// Inventory lists the Nodes expected to be registered with the Controllers
+type Inventory struct {
+	Nodes []Node `yaml:"nodes"`
+}
+
+// Node is an expected Node, identified by ID or, when no ID is set, by name. Empty Groups and Arch aren't checked.
+type Node struct {
+	ID         string   `yaml:"id"`
+	Name       string   `yaml:"name"`
+	Arch       string   `yaml:"arch"`
+	Groups     []string `yaml:"groups"`     // names or IDs of the groups the Node should belong to, and only those
+	Controller string   `yaml:"controller"` // name of the Controller the Node registers with; any Controller when empty
+}
+
+func Load(path string) (*Inventory, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading inventory file %s: %w", path, err)
+	}
+	inv := &Inventory{}
+	if err := yaml.UnmarshalStrict(data, inv); err != nil {
+		return nil, fmt.Errorf("parsing inventory file %s: %w", path, err)
+	}
+	if err := inv.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid inventory file %s: %w", path, err)
+	}
+	return inv, nil
+}
+
+// Validate ensures every Node can be identified, only once, and has a known architecture
+func (inv *Inventory) Validate() error {
+	keys := map[string]bool{}
+	for i, node := range inv.Nodes {
+		if node.ID == "" && node.Name == "" {
+			return fmt.Errorf("node %d has neither id nor name", i)
+		}
+		if node.Arch != "" && !slices.Contains(types.Architectures, node.Arch) {
+			return fmt.Errorf("node %s has unknown arch %s (one of %s)", node.key(), node.Arch, strings.Join(types.Architectures, ", "))
+		}
+		key := node.Controller + "|" + node.key()
+		if keys[key] {
+			return fmt.Errorf("node %s is listed more than once", node.key())
+		}
+		keys[key] = true
+	}
+	return nil
+}
+
+// ForController returns the Nodes expected on a Controller; it is safe to call on a nil Inventory, which returns nil
+func (inv *Inventory) ForController(name string) *Inventory {
+	if inv == nil {
+		return nil
+	}
+	filtered := &Inventory{}
+	for _, node := range inv.Nodes {
+		if node.Controller == "" || node.Controller == name {
+			filtered.Nodes = append(filtered.Nodes, node)
+		}
+	}
+	return filtered
+}
+
+func (node Node) key() string {
+	if node.ID != "" {
+		return node.ID
+	}
+	return node.Name
+}
+
+// Matches reports whether the Controller's node is this expected Node
+func (node Node) Matches(actual types.Node) bool {
+	if node.ID != "" {
+		return node.ID == actual.NodeID
+	}
+	return node.Name == actual.NodeName
+}
+
+// GroupsMatch reports whether the node belongs to the expected groups, and only those
+func (node Node) GroupsMatch(actual types.Node) bool {
+	if len(node.Groups) == 0 {
+		return true
+	}
+	for _, group := range actual.Groups {
+		if !slices.Contains(node.Groups, group.Id) && !slices.Contains(node.Groups, group.Name) {
+			return false
+		}
+	}
+	for _, expected := range node.Groups {
+		if !slices.ContainsFunc(actual.Groups, func(group types.NodeGroup) bool { return group.Id == expected || group.Name == expected }) {
+			return false
+		}
+	}
+	return true
+}
+
+// ArchMatches reports whether the node has the expected architecture
+func (node Node) ArchMatches(actual types.Node) bool {
+	return node.Arch == "" || node.Arch == actual.HostArch
+}
@@ -0,0 +1,61 @@
+package inventory
+
+import (
+	"testing"
+
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []Node
+		err   bool
+	}{
+		{name: "valid", nodes: []Node{{ID: "n1", Arch: "arm64"}, {Name: "mac-2"}}},
+		{name: "same node on two controllers", nodes: []Node{{ID: "n1", Controller: "a"}, {ID: "n1", Controller: "b"}}},
+		{name: "neither id nor name", nodes: []Node{{Arch: "arm64"}}, err: true},
+		{name: "unknown arch", nodes: []Node{{ID: "n1", Arch: "sparc"}}, err: true},
+		{name: "listed twice", nodes: []Node{{ID: "n1"}, {ID: "n1", Arch: "arm64"}}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := (&Inventory{Nodes: test.nodes}).Validate(); (err != nil) != test.err {
+				t.Errorf("Validate() = %v, expected an error: %t", err, test.err)
+			}
+		})
+	}
+}
+
+func TestGroupsMatch(t *testing.T) {
+	actual := types.Node{Groups: []types.NodeGroup{{Id: "g1", Name: "ci"}, {Id: "g2", Name: "release"}}}
+	tests := []struct {
+		name   string
+		groups []string
+		match  bool
+	}{
+		{name: "not checked", match: true},
+		{name: "by name", groups: []string{"ci", "release"}, match: true},
+		{name: "by id and name", groups: []string{"g1", "release"}, match: true},
+		{name: "extra group", groups: []string{"ci"}},
+		{name: "missing group", groups: []string{"ci", "release", "nightly"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if match := (Node{ID: "n1", Groups: test.groups}).GroupsMatch(actual); match != test.match {
+				t.Errorf("GroupsMatch() = %t, expected %t", match, test.match)
+			}
+		})
+	}
+}
+
+func TestForController(t *testing.T) {
+	inv := &Inventory{Nodes: []Node{{ID: "n1"}, {ID: "n2", Controller: "a"}, {ID: "n3", Controller: "b"}}}
+	filtered := inv.ForController("a")
+	if len(filtered.Nodes) != 2 || filtered.Nodes[0].ID != "n1" || filtered.Nodes[1].ID != "n2" {
+		t.Errorf("nodes of controller a = %+v, expected n1 and n2", filtered.Nodes)
+	}
+	if (*Inventory)(nil).ForController("a") != nil {
+		t.Error("a nil inventory has nodes")
+	}
+}
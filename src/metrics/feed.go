@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/veertuinc/anka-prometheus-exporter/src/events"
+)
+
+// feed runs the tracker shared by a family of metrics: it is updated once per payload, then every metric of the family handles the same update.
+// Trackers diff consecutive responses, so they can't be updated by each metric: the second update would diff the response against itself.
+type feed[T, U any] struct {
+	name         string // of the bus handler
+	update       func(T) U
+	handlers     map[string]func(U) error
+	subscription events.Subscription // nil while no metric is subscribed
+	lock         *sync.Mutex
+}
+
+func newFeed[T, U any](name string, update func(T) U) *feed[T, U] {
+	return &feed[T, U]{name: name, update: update, handlers: map[string]func(U) error{}, lock: &sync.Mutex{}}
+}
+
+// subscribe adds the handler of a metric; the feed subscribes to the topic along with the first one
+func (f *feed[T, U]) subscribe(topic *events.Topic[T], name string, handler func(U) error) events.Subscription {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.handlers[name] = handler
+	if f.subscription == nil {
+		f.subscription = topic.Subscribe(f.name, f.publish)
+	}
+	return feedSubscription[T, U]{feed: f, name: name}
+}
+
+func (f *feed[T, U]) publish(data T) error {
+	f.lock.Lock()
+	handlers := make(map[string]func(U) error, len(f.handlers))
+	for name, handler := range f.handlers {
+		handlers[name] = handler
+	}
+	f.lock.Unlock()
+	update := f.update(data)
+	errs := []error{}
+	for name, handler := range handlers {
+		if err := handler(update); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type feedSubscription[T, U any] struct {
+	feed *feed[T, U]
+	name string
+}
+
+// Unsubscribe removes the handler of the metric; the feed leaves the topic with the last one
+func (fs feedSubscription[T, U]) Unsubscribe() {
+	fs.feed.lock.Lock()
+	defer fs.feed.lock.Unlock()
+	delete(fs.feed.handlers, fs.name)
+	if len(fs.feed.handlers) == 0 && fs.feed.subscription != nil {
+		fs.feed.subscription.Unsubscribe()
+		fs.feed.subscription = nil
+	}
+}
@@ -0,0 +1,159 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/veertuinc/anka-prometheus-exporter/src/events"
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
+const (
+	INSTANCE_STATE_STARTED    = "Started"
+	INSTANCE_STATE_TERMINATED = "Terminated"
+)
+
+var instanceLifecycleLabels = []string{"template_uuid", "template_name", "group_uuid", "arch"}
+
+// instanceTracker remembers the instances of the previous /api/v1/vm response, so consecutive responses can be diffed by InstanceID
+type instanceTracker struct {
+	instances map[string]types.VmData
+	lock      *sync.Mutex
+}
+
+func newInstanceTracker() *instanceTracker {
+	return &instanceTracker{lock: &sync.Mutex{}}
+}
+
+// update stores the instances and returns the previous ones; previous is nil for the first response (nothing can be counted yet)
+func (tracker *instanceTracker) update(instances []types.Instance) (previous map[string]types.VmData, current map[string]types.VmData) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	current = make(map[string]types.VmData, len(instances))
+	for _, instance := range instances {
+		current[instance.InstanceID] = instance.Vm
+	}
+	previous = tracker.instances
+	tracker.instances = current
+	return previous, current
+}
+
+// restore makes the next response diffed against the instances of a checkpoint
+func (tracker *instanceTracker) restore(lastSeen LastSeen) {
+	if !lastSeen.InstancesLoaded {
+		return
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	tracker.instances = make(map[string]types.VmData, len(lastSeen.Instances))
+	for _, instance := range lastSeen.Instances {
+		tracker.instances[instance.InstanceID] = instance.Vm
+	}
+}
+
+// instanceDiff is a response of /api/v1/vm along with the previous one
+type instanceDiff struct {
+	previous map[string]types.VmData // nil for the first response (nothing can be counted yet)
+	current  map[string]types.VmData
+}
+
+type InstanceLifecycleMetric struct {
+	BaseAnkaMetric[*prometheus.CounterVec]
+	tracker    *instanceTracker
+	feed       *feed[[]types.Instance, instanceDiff]
+	HandleData func(previous map[string]types.VmData, current map[string]types.VmData, metric *prometheus.CounterVec)
+}
+
+func (ilm InstanceLifecycleMetric) diffsRequests() {}
+
+func (ilm InstanceLifecycleMetric) Subscribe(bus *events.Bus) events.Subscription {
+	return ilm.feed.subscribe(bus.Instances, ilm.GetName(), func(diff instanceDiff) error {
+		if diff.previous == nil {
+			return nil
+		}
+		ilm.HandleData(diff.previous, diff.current, ilm.metric)
+		return nil
+	})
+}
+
+func (ilm InstanceLifecycleMetric) Checkpoint() ([]CounterSample, error) {
+	return counterSamples(ilm.metric)
+}
+
+func (ilm InstanceLifecycleMetric) Restore(samples []CounterSample, lastSeen LastSeen) error {
+	ilm.tracker.restore(lastSeen)
+	return restoreCounterSamples(ilm.metric, samples)
+}
+
+func instanceLifecycleLabelValues(vm types.VmData, extra ...string) []string {
+	return append([]string{vm.TemplateUUID, vm.TemplateName, vm.GroupUUID, vm.Arch}, extra...)
+}
+
+func ankaInstanceLifecycleMetrics() []InstanceLifecycleMetric {
+	metrics := []InstanceLifecycleMetric{
+		{
+			BaseAnkaMetric: newCounterVecMetric("anka_instance_created_total", "Count of Instances that appeared since the previous request (label: template_uuid, template_name, group_uuid, arch)", instanceLifecycleLabels, events.EVENT_VM_DATA_UPDATED),
+			HandleData: func(previous map[string]types.VmData, current map[string]types.VmData, metric *prometheus.CounterVec) {
+				for instanceID, vm := range current {
+					if _, ok := previous[instanceID]; !ok {
+						metric.WithLabelValues(instanceLifecycleLabelValues(vm)...).Inc()
+					}
+				}
+			},
+		},
+		{
+			BaseAnkaMetric: newCounterVecMetric("anka_instance_state_transitions_total", "Count of Instance state changes between two requests (label: from, to, template_uuid, template_name, group_uuid, arch)", append(instanceLifecycleLabels, "from", "to"), events.EVENT_VM_DATA_UPDATED),
+			HandleData: func(previous map[string]types.VmData, current map[string]types.VmData, metric *prometheus.CounterVec) {
+				for instanceID, vm := range current {
+					if previousVm, ok := previous[instanceID]; ok && previousVm.State != vm.State {
+						metric.WithLabelValues(instanceLifecycleLabelValues(vm, previousVm.State, vm.State)...).Inc()
+					}
+				}
+			},
+		},
+		{
+			BaseAnkaMetric: newCounterVecMetric("anka_instance_terminated_total", "Count of Instances that were terminated or disappeared since the previous request, by the last state seen before (label: from, template_uuid, template_name, group_uuid, arch)", append(instanceLifecycleLabels, "from"), events.EVENT_VM_DATA_UPDATED),
+			HandleData: func(previous map[string]types.VmData, current map[string]types.VmData, metric *prometheus.CounterVec) {
+				for instanceID, vm := range current {
+					if vm.State != INSTANCE_STATE_TERMINATED {
+						continue
+					}
+					previousVm, ok := previous[instanceID]
+					if !ok {
+						// created and terminated between two requests
+						metric.WithLabelValues(instanceLifecycleLabelValues(vm, "unknown")...).Inc()
+					} else if previousVm.State != INSTANCE_STATE_TERMINATED {
+						metric.WithLabelValues(instanceLifecycleLabelValues(vm, previousVm.State)...).Inc()
+					}
+				}
+				// instances removed from the Controller without being seen as Terminated
+				for instanceID, previousVm := range previous {
+					if _, ok := current[instanceID]; !ok && previousVm.State != INSTANCE_STATE_TERMINATED {
+						metric.WithLabelValues(instanceLifecycleLabelValues(previousVm, previousVm.State)...).Inc()
+					}
+				}
+			},
+		},
+	}
+	// one tracker per controller: every counter handles the same diff
+	tracker := newInstanceTracker()
+	instanceFeed := newFeed("instance_lifecycle", func(instances []types.Instance) instanceDiff {
+		previous, current := tracker.update(instances)
+		return instanceDiff{previous: previous, current: current}
+	})
+	for i := range metrics {
+		metrics[i].tracker = tracker
+		metrics[i].feed = instanceFeed
+	}
+	return metrics
+}
+
+func init() { // runs on exporter init only (updates are made with the above EventHandler; triggered by the Client)
+	AddMetrics(func(options Options) []AnkaMetric {
+		metrics := []AnkaMetric{}
+		for _, instanceLifecycleMetric := range ankaInstanceLifecycleMetrics() {
+			metrics = append(metrics, instanceLifecycleMetric)
+		}
+		return metrics
+	})
+}
@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/veertuinc/anka-prometheus-exporter/src/events"
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
+// counterValues reads every series of the counter, keyed by the values of the given labels joined with "/"
+func counterValues(t *testing.T, counter *prometheus.CounterVec, labels ...string) map[string]float64 {
+	t.Helper()
+	samples, err := counterSamples(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, sample := range samples {
+		key := []string{}
+		for _, label := range labels {
+			key = append(key, sample.Labels[label])
+		}
+		values[strings.Join(key, "/")] += sample.Value
+	}
+	return values
+}
+
+func expectValues(t *testing.T, name string, values map[string]float64, expected map[string]float64) {
+	t.Helper()
+	if len(values) != len(expected) {
+		t.Errorf("%s = %v, expected %v", name, values, expected)
+		return
+	}
+	for key, value := range expected {
+		if values[key] != value {
+			t.Errorf("%s = %v, expected %v", name, values, expected)
+			return
+		}
+	}
+}
+
+// lifecycleInstance is an instance whose template UUID is its ID, so the series can be told apart
+func lifecycleInstance(id string, state string) types.Instance {
+	return types.Instance{InstanceID: id, Vm: types.VmData{State: state, TemplateUUID: id}}
+}
+
+func TestInstanceLifecycle(t *testing.T) {
+	tests := []struct {
+		name        string
+		previous    []types.Instance
+		current     []types.Instance
+		created     map[string]float64 // by template_uuid
+		transitions map[string]float64 // by template_uuid/from/to
+		terminated  map[string]float64 // by template_uuid/from
+	}{
+		{
+			name:     "unchanged",
+			previous: []types.Instance{lifecycleInstance("i1", "Started")},
+			current:  []types.Instance{lifecycleInstance("i1", "Started")},
+		},
+		{
+			name:        "created and changed state",
+			previous:    []types.Instance{lifecycleInstance("i1", "Scheduling")},
+			current:     []types.Instance{lifecycleInstance("i1", "Started"), lifecycleInstance("i2", "Scheduling")},
+			created:     map[string]float64{"i2": 1},
+			transitions: map[string]float64{"i1/Scheduling/Started": 1},
+		},
+		{
+			name:        "terminated",
+			previous:    []types.Instance{lifecycleInstance("i1", "Started")},
+			current:     []types.Instance{lifecycleInstance("i1", INSTANCE_STATE_TERMINATED)},
+			transitions: map[string]float64{"i1/Started/Terminated": 1},
+			terminated:  map[string]float64{"i1/Started": 1},
+		},
+		{
+			name:       "created and terminated in between",
+			current:    []types.Instance{lifecycleInstance("i1", INSTANCE_STATE_TERMINATED)},
+			created:    map[string]float64{"i1": 1},
+			terminated: map[string]float64{"i1/unknown": 1},
+		},
+		{
+			name:       "removed without being seen Terminated",
+			previous:   []types.Instance{lifecycleInstance("i1", "Stopped")},
+			terminated: map[string]float64{"i1/Stopped": 1},
+		},
+		{
+			name:     "removed once Terminated",
+			previous: []types.Instance{lifecycleInstance("i1", INSTANCE_STATE_TERMINATED)},
+		},
+		{
+			name:     "still Terminated",
+			previous: []types.Instance{lifecycleInstance("i1", INSTANCE_STATE_TERMINATED)},
+			current:  []types.Instance{lifecycleInstance("i1", INSTANCE_STATE_TERMINATED)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bus := events.NewBus("test")
+			metrics := map[string]*prometheus.CounterVec{}
+			for _, m := range ankaInstanceLifecycleMetrics() {
+				m.Subscribe(bus)
+				metrics[m.GetName()] = m.metric
+			}
+			bus.Instances.Publish(test.previous)
+			for name, metric := range metrics {
+				if values := counterValues(t, metric); len(values) != 0 {
+					t.Fatalf("the first response counted %s = %v", name, values)
+				}
+			}
+			bus.Instances.Publish(test.current)
+			expectValues(t, "created", counterValues(t, metrics["anka_instance_created_total"], "template_uuid"), test.created)
+			expectValues(t, "transitions", counterValues(t, metrics["anka_instance_state_transitions_total"], "template_uuid", "from", "to"), test.transitions)
+			expectValues(t, "terminated", counterValues(t, metrics["anka_instance_terminated_total"], "template_uuid", "from"), test.terminated)
+		})
+	}
+}
+
+// After a restore, the first response is diffed against the checkpointed instances and the counters carry on from their samples
+func TestInstanceLifecycleRestore(t *testing.T) {
+	bus := events.NewBus("test")
+	var created InstanceLifecycleMetric
+	for _, m := range ankaInstanceLifecycleMetrics() {
+		if m.GetName() == "anka_instance_created_total" {
+			created = m
+		}
+	}
+	samples := []CounterSample{{Labels: map[string]string{"template_uuid": "i0", "template_name": "", "group_uuid": "", "arch": ""}, Value: 4}}
+	if err := created.Restore(samples, LastSeen{Instances: []types.Instance{lifecycleInstance("i1", "Started")}, InstancesLoaded: true}); err != nil {
+		t.Fatal(err)
+	}
+	created.Subscribe(bus)
+	bus.Instances.Publish([]types.Instance{lifecycleInstance("i1", "Started"), lifecycleInstance("i2", "Started")})
+	expectValues(t, "created", counterValues(t, created.metric, "template_uuid"), map[string]float64{"i0": 4, "i2": 1})
+}
@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/veertuinc/anka-prometheus-exporter/src/events"
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
+var schedulingLatencyBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200}
+
+// schedulingTracker remembers which instances were already seen Started, so the scheduling latency of each instance is observed once
+type schedulingTracker struct {
+	started map[string]bool
+	loaded  bool
+	lock    *sync.Mutex
+}
+
+func newSchedulingTracker() *schedulingTracker {
+	return &schedulingTracker{started: map[string]bool{}, lock: &sync.Mutex{}}
+}
+
+type schedulingLatency struct {
+	vm      types.VmData
+	latency time.Duration
+}
+
+// update returns the time between creation and start of the instances seen Started for the first time.
+// Instances already started on the first request are skipped: we don't know when they started.
+func (tracker *schedulingTracker) update(instances []types.Instance, now time.Time) []schedulingLatency {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	latencies := []schedulingLatency{}
+	started := make(map[string]bool, len(instances))
+	for _, instance := range instances {
+		vm := instance.Vm
+		alreadyStarted, seen := tracker.started[instance.InstanceID]
+		isStarted := vm.State != "Scheduling" && vm.State != "Pulling"
+		started[instance.InstanceID] = alreadyStarted || isStarted
+		if !isStarted || alreadyStarted || (!seen && !tracker.loaded) || vm.State != "Started" {
+			continue
+		}
+		createdAt, err := time.Parse(time.RFC3339, vm.CreationTime)
+		if err != nil {
+			continue
+		}
+		// ts is updated when the instance starts, otherwise the start is dated when we noticed it
+		startedAt := parseInstanceTime(vm.LastUpdateTime, now)
+		if startedAt.Before(createdAt) || startedAt.After(now) {
+			startedAt = now
+		}
+		latencies = append(latencies, schedulingLatency{vm: vm, latency: startedAt.Sub(createdAt)})
+	}
+	tracker.started = started
+	tracker.loaded = true
+	return latencies
+}
+
+type SchedulingLatencyMetric struct {
+	BaseAnkaMetric[*prometheus.HistogramVec]
+	feed       *feed[[]types.Instance, []schedulingLatency]
+	HandleData func([]schedulingLatency, *prometheus.HistogramVec)
+}
+
+func (slm SchedulingLatencyMetric) diffsRequests() {}
+
+func (slm SchedulingLatencyMetric) Subscribe(bus *events.Bus) events.Subscription {
+	return slm.feed.subscribe(bus.Instances, slm.GetName(), func(latencies []schedulingLatency) error {
+		slm.HandleData(latencies, slm.metric)
+		return nil
+	})
+}
+
+func ankaSchedulingLatencyMetrics() []SchedulingLatencyMetric {
+	metrics := []SchedulingLatencyMetric{
+		{
+			BaseAnkaMetric: newHistogramVecMetric("anka_instance_scheduling_latency_per_group_seconds", "Time between the creation of Instances and their start, per Group (label: group_uuid)", []string{"group_uuid"}, schedulingLatencyBuckets, events.EVENT_VM_DATA_UPDATED),
+			HandleData: func(latencies []schedulingLatency, metric *prometheus.HistogramVec) {
+				for _, l := range latencies {
+					metric.WithLabelValues(l.vm.GroupUUID).Observe(l.latency.Seconds())
+				}
+			},
+		},
+		{
+			BaseAnkaMetric: newHistogramVecMetric("anka_instance_scheduling_latency_per_template_seconds", "Time between the creation of Instances and their start, per Template (label: template_uuid, template_name)", []string{"template_uuid", "template_name"}, schedulingLatencyBuckets, events.EVENT_VM_DATA_UPDATED),
+			HandleData: func(latencies []schedulingLatency, metric *prometheus.HistogramVec) {
+				for _, l := range latencies {
+					metric.WithLabelValues(l.vm.TemplateUUID, l.vm.TemplateName).Observe(l.latency.Seconds())
+				}
+			},
+		},
+	}
+	// one tracker per controller, so the latency of each instance is computed once for both histograms
+	tracker := newSchedulingTracker()
+	latencyFeed := newFeed("instance_scheduling_latency", func(instances []types.Instance) []schedulingLatency {
+		return tracker.update(instances, time.Now())
+	})
+	for i := range metrics {
+		metrics[i].feed = latencyFeed
+	}
+	return metrics
+}
+
+func ankaSchedulingQueueMetrics() []InstanceStatePerMetric {
+	return []InstanceStatePerMetric{
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_instance_scheduling_queue_depth", "Count of Instances waiting in Scheduling, per Group (label: group_uuid)", []string{"group_uuid"}, events.EVENT_VM_DATA_UPDATED),
+			HandleData: func(instances []types.Instance, metric *prometheus.GaugeVec) {
+				depth := map[string]int{}
+				for _, instance := range instances {
+					if instance.Vm.State == "Scheduling" {
+						depth[instance.Vm.GroupUUID]++
+					} else if _, ok := depth[instance.Vm.GroupUUID]; !ok {
+						depth[instance.Vm.GroupUUID] = 0 // groups with Instances but an empty queue report 0
+					}
+				}
+				for groupUUID, count := range depth {
+					metric.With(prometheus.Labels{"group_uuid": groupUUID}).Set(float64(count))
+				}
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_instance_scheduling_oldest_seconds", "Age of the oldest Instance waiting in Scheduling, per Group. Visible only for groups with at least one Instance in Scheduling (label: group_uuid)", []string{"group_uuid"}, events.EVENT_VM_DATA_UPDATED),
+			HandleData: func(instances []types.Instance, metric *prometheus.GaugeVec) {
+				oldest := map[string]float64{}
+				now := time.Now()
+				for _, instance := range instances {
+					if instance.Vm.State != "Scheduling" {
+						continue
+					}
+					createdAt, err := time.Parse(time.RFC3339, instance.Vm.CreationTime)
+					if err != nil {
+						continue
+					}
+					oldest[instance.Vm.GroupUUID] = max(oldest[instance.Vm.GroupUUID], now.Sub(createdAt).Seconds())
+				}
+				for groupUUID, age := range oldest {
+					metric.With(prometheus.Labels{"group_uuid": groupUUID}).Set(age)
+				}
+			},
+		},
+	}
+}
+
+func init() { // runs on exporter init only (updates are made with the above EventHandler; triggered by the Client)
+	AddMetrics(func(options Options) []AnkaMetric {
+		metrics := []AnkaMetric{}
+		for _, schedulingLatencyMetric := range ankaSchedulingLatencyMetrics() {
+			metrics = append(metrics, schedulingLatencyMetric)
+		}
+		for _, schedulingQueueMetric := range ankaSchedulingQueueMetrics() {
+			metrics = append(metrics, schedulingQueueMetric)
+		}
+		return metrics
+	})
+}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
+func TestSchedulingTracker(t *testing.T) {
+	tests := []struct {
+		name      string
+		requests  [][]types.Instance // 30 seconds apart, from clockStart
+		latencies map[string]float64 // observed on the last request, by template_uuid: seconds
+	}{
+		{
+			name:     "started before the first request",
+			requests: [][]types.Instance{{clockInstance("i1", "Started", after(10*time.Second), after(0))}},
+		},
+		{
+			name:      "started after the first request",
+			requests:  [][]types.Instance{{}, {clockInstance("i1", "Started", after(25*time.Second), after(5*time.Second))}},
+			latencies: map[string]float64{"i1": 20},
+		},
+		{
+			name:      "Scheduling on the first request",
+			requests:  [][]types.Instance{{clockInstance("i1", "Scheduling", nil, after(-10*time.Second))}, {clockInstance("i1", "Started", after(20*time.Second), after(-10*time.Second))}},
+			latencies: map[string]float64{"i1": 30},
+		},
+		{
+			name:     "observed once",
+			requests: [][]types.Instance{{}, {clockInstance("i1", "Started", after(25*time.Second), after(5*time.Second))}, {clockInstance("i1", "Started", after(25*time.Second), after(5*time.Second))}},
+		},
+		{
+			name:     "no creation time",
+			requests: [][]types.Instance{{}, {clockInstance("i1", "Started", after(50*time.Second), nil)}},
+		},
+		{
+			name:      "start dated when noticed",
+			requests:  [][]types.Instance{{}, {clockInstance("i1", "Scheduling", nil, after(20*time.Second))}, {clockInstance("i1", "Started", nil, after(20*time.Second))}},
+			latencies: map[string]float64{"i1": 40},
+		},
+		{
+			name: "Started after being seen past Scheduling",
+			requests: [][]types.Instance{
+				{},
+				{clockInstance("i1", "Scheduling", nil, after(20*time.Second))},
+				{clockInstance("i1", "Stopped", after(50*time.Second), after(20*time.Second))},
+				{clockInstance("i1", "Started", after(80*time.Second), after(20*time.Second))},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := newSchedulingTracker()
+			var latencies []schedulingLatency
+			for i, instances := range test.requests {
+				latencies = tracker.update(instances, clockStart.Add(time.Duration(i)*30*time.Second))
+			}
+			seconds := map[string]float64{}
+			for _, latency := range latencies {
+				seconds[latency.vm.TemplateUUID] += latency.latency.Seconds()
+			}
+			expectValues(t, "latencies", seconds, test.latencies)
+		})
+	}
+}
+
+func TestSchedulingQueueDepth(t *testing.T) {
+	depth := ankaSchedulingQueueMetrics()[0]
+	metric := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: depth.GetName()}, []string{"group_uuid"})
+	depth.HandleData([]types.Instance{
+		{Vm: types.VmData{State: "Scheduling", GroupUUID: "g1"}},
+		{Vm: types.VmData{State: "Started", GroupUUID: "g1"}},
+		{Vm: types.VmData{State: "Scheduling", GroupUUID: "g1"}},
+		{Vm: types.VmData{State: "Started", GroupUUID: "g2"}},
+	}, metric)
+	if g1, g2 := testutil.ToFloat64(metric.WithLabelValues("g1")), testutil.ToFloat64(metric.WithLabelValues("g2")); g1 != 2 || g2 != 0 {
+		t.Errorf("queue depths = %v and %v, expected 2 and 0", g1, g2)
+	}
+}
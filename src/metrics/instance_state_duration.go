@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/veertuinc/anka-prometheus-exporter/src/events"
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
+// States whose duration is observed; Stopped, Terminated and Error are final or parked states
+var timedInstanceStates = []string{"Scheduling", "Pulling", "Started", "Stopping", "Terminating"}
+
+var instanceStateDurationBuckets = []float64{5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200, 14400, 28800, 86400}
+
+type instanceStateEntry struct {
+	state     string
+	enteredAt time.Time
+	known     bool // false when enteredAt is only an estimate: the instance was already in this state before the exporter saw it
+}
+
+// instanceStateClock records when every instance entered its current state, to observe the time spent in it when it leaves
+type instanceStateClock struct {
+	instances map[string]instanceStateEntry
+	lastSeen  map[string]types.VmData // labels of the instances, for the ones that disappear
+	loaded    bool
+	lock      *sync.Mutex
+}
+
+func newInstanceStateClock() *instanceStateClock {
+	return &instanceStateClock{instances: map[string]instanceStateEntry{}, lock: &sync.Mutex{}}
+}
+
+type instanceStateExit struct {
+	vm       types.VmData
+	state    string
+	duration time.Duration
+}
+
+// update returns the states left since the previous request and how long the instances spent in them
+func (clock *instanceStateClock) update(instances []types.Instance, now time.Time) []instanceStateExit {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	exits := []instanceStateExit{}
+	current := make(map[string]instanceStateEntry, len(instances))
+	lastSeen := make(map[string]types.VmData, len(instances))
+	for _, instance := range instances {
+		vm := instance.Vm
+		lastSeen[instance.InstanceID] = vm
+		previous, ok := clock.instances[instance.InstanceID]
+		switch {
+		case !ok:
+			enteredAt := parseInstanceTime(vm.LastUpdateTime, now)
+			if vm.State == "Scheduling" {
+				enteredAt = parseInstanceTime(vm.CreationTime, now)
+			}
+			// no way to tell when instances seen on the first request entered their state, unless they are still Scheduling
+			known := clock.loaded || (vm.State == "Scheduling" && vm.CreationTime != "")
+			current[instance.InstanceID] = instanceStateEntry{state: vm.State, enteredAt: enteredAt, known: known}
+		case previous.state != vm.State:
+			// ts is updated on state changes, otherwise the change is dated when we noticed it
+			leftAt := parseInstanceTime(vm.LastUpdateTime, now)
+			if leftAt.Before(previous.enteredAt) || leftAt.After(now) {
+				leftAt = now
+			}
+			if previous.known {
+				exits = append(exits, instanceStateExit{vm: vm, state: previous.state, duration: leftAt.Sub(previous.enteredAt)})
+			}
+			current[instance.InstanceID] = instanceStateEntry{state: vm.State, enteredAt: leftAt, known: true}
+		default:
+			current[instance.InstanceID] = previous
+		}
+	}
+	// instances removed from the Controller left their last state when we noticed it
+	for instanceID, previous := range clock.instances {
+		if _, ok := current[instanceID]; !ok && previous.known {
+			exits = append(exits, instanceStateExit{vm: clock.lastSeen[instanceID], state: previous.state, duration: now.Sub(previous.enteredAt)})
+		}
+	}
+	clock.instances = current
+	clock.lastSeen = lastSeen
+	clock.loaded = true
+	return exits
+}
+
+// entry returns when the instance entered its current state, as of the last update
+func (clock *instanceStateClock) entry(instanceID string) (instanceStateEntry, bool) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	entry, ok := clock.instances[instanceID]
+	return entry, ok
+}
+
+func parseInstanceTime(value string, fallback time.Time) time.Time {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fallback
+	}
+	return parsed
+}
+
+type InstanceStateDurationMetric struct {
+	BaseAnkaMetric[*prometheus.HistogramVec]
+	clock      *instanceStateClock
+	HandleData func([]instanceStateExit, *prometheus.HistogramVec)
+}
+
+func (isdm InstanceStateDurationMetric) diffsRequests() {}
+
+func (isdm InstanceStateDurationMetric) Subscribe(bus *events.Bus) events.Subscription {
+	return bus.Instances.Subscribe(isdm.GetName(), func(instances []types.Instance) error {
+		isdm.HandleData(isdm.clock.update(instances, time.Now()), isdm.metric)
+		return nil
+	})
+}
+
+func ankaInstanceStateDurationMetrics() []InstanceStateDurationMetric {
+	return []InstanceStateDurationMetric{
+		{
+			BaseAnkaMetric: newHistogramVecMetric("anka_instance_state_duration_seconds", "Time Instances spent in a state, observed when they leave it (label: state, template_uuid, template_name, group_uuid)", []string{"state", "template_uuid", "template_name", "group_uuid"}, instanceStateDurationBuckets, events.EVENT_VM_DATA_UPDATED),
+			clock:          newInstanceStateClock(),
+			HandleData: func(exits []instanceStateExit, metric *prometheus.HistogramVec) {
+				for _, exit := range exits {
+					if !slices.Contains(timedInstanceStates, exit.state) || exit.duration < 0 {
+						continue
+					}
+					metric.WithLabelValues(exit.state, exit.vm.TemplateUUID, exit.vm.TemplateName, exit.vm.GroupUUID).Observe(exit.duration.Seconds())
+				}
+			},
+		},
+	}
+}
+
+func init() { // runs on exporter init only (updates are made with the above EventHandler; triggered by the Client)
+	AddMetrics(func(options Options) []AnkaMetric {
+		metrics := []AnkaMetric{}
+		for _, instanceStateDurationMetric := range ankaInstanceStateDurationMetrics() {
+			metrics = append(metrics, instanceStateDurationMetric)
+		}
+		return metrics
+	})
+}
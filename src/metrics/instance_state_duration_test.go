@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
+var clockStart = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// clockInstance is an instance whose template UUID is its ID; ts and cr are relative to clockStart, nil when missing
+func clockInstance(id string, state string, ts *time.Duration, cr *time.Duration) types.Instance {
+	vm := types.VmData{State: state, TemplateUUID: id}
+	if ts != nil {
+		vm.LastUpdateTime = clockStart.Add(*ts).Format(time.RFC3339)
+	}
+	if cr != nil {
+		vm.CreationTime = clockStart.Add(*cr).Format(time.RFC3339)
+	}
+	return types.Instance{InstanceID: id, Vm: vm}
+}
+
+func TestInstanceStateClock(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests [][]types.Instance // 30 seconds apart, from clockStart
+		exits    map[string]float64 // state left on the last request, by template_uuid/state: seconds
+	}{
+		{
+			name:     "state entered before the first request",
+			requests: [][]types.Instance{{clockInstance("i1", "Started", nil, nil)}, {clockInstance("i1", "Stopping", after(20*time.Second), nil)}},
+		},
+		{
+			name:     "Scheduling since creation",
+			requests: [][]types.Instance{{clockInstance("i1", "Scheduling", nil, after(-10*time.Second))}, {clockInstance("i1", "Started", after(20*time.Second), nil)}},
+			exits:    map[string]float64{"i1/Scheduling": 30},
+		},
+		{
+			name:     "unchanged",
+			requests: [][]types.Instance{{}, {clockInstance("i1", "Pulling", after(20*time.Second), nil)}, {clockInstance("i1", "Pulling", after(20*time.Second), nil)}},
+		},
+		{
+			name:     "left at ts",
+			requests: [][]types.Instance{{}, {clockInstance("i1", "Pulling", after(20*time.Second), nil)}, {clockInstance("i1", "Started", after(50*time.Second), nil)}},
+			exits:    map[string]float64{"i1/Pulling": 30},
+		},
+		{
+			name:     "left without ts",
+			requests: [][]types.Instance{{}, {clockInstance("i1", "Pulling", after(10*time.Second), nil)}, {clockInstance("i1", "Started", nil, nil)}},
+			exits:    map[string]float64{"i1/Pulling": 50},
+		},
+		{
+			name:     "ts before the state was entered",
+			requests: [][]types.Instance{{}, {clockInstance("i1", "Pulling", after(10*time.Second), nil)}, {clockInstance("i1", "Started", after(5*time.Second), nil)}},
+			exits:    map[string]float64{"i1/Pulling": 50},
+		},
+		{
+			name:     "removed",
+			requests: [][]types.Instance{{}, {clockInstance("i1", "Pulling", after(10*time.Second), nil)}, {}},
+			exits:    map[string]float64{"i1/Pulling": 50},
+		},
+		{
+			name:     "removed before its state was known",
+			requests: [][]types.Instance{{clockInstance("i1", "Started", nil, nil)}, {}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := newInstanceStateClock()
+			var exits []instanceStateExit
+			for i, instances := range test.requests {
+				exits = clock.update(instances, clockStart.Add(time.Duration(i)*30*time.Second))
+			}
+			seconds := map[string]float64{}
+			for _, exit := range exits {
+				seconds[exit.vm.TemplateUUID+"/"+exit.state] += exit.duration.Seconds()
+			}
+			expectValues(t, "exits", seconds, test.exits)
+		})
+	}
+}
+
+// Only the time spent in timed states is observed
+func TestInstanceStateDurationHandleData(t *testing.T) {
+	m := ankaInstanceStateDurationMetrics()[0]
+	m.HandleData([]instanceStateExit{
+		{vm: types.VmData{TemplateUUID: "t1"}, state: "Pulling", duration: 30 * time.Second},
+		{vm: types.VmData{TemplateUUID: "t1"}, state: "Stopped", duration: 30 * time.Second},
+		{vm: types.VmData{TemplateUUID: "t1"}, state: "Started", duration: -time.Second},
+	}, m.metric)
+	observed := map[string]uint64{}
+	for _, state := range []string{"Pulling", "Stopped", "Started"} {
+		out := &dto.Metric{}
+		if err := m.metric.WithLabelValues(state, "t1", "", "").(prometheus.Metric).Write(out); err != nil {
+			t.Fatal(err)
+		}
+		observed[state] = out.GetHistogram().GetSampleCount()
+	}
+	if observed["Pulling"] != 1 || observed["Stopped"] != 0 || observed["Started"] != 0 {
+		t.Errorf("observations by state = %v, expected only one for Pulling", observed)
+	}
+}
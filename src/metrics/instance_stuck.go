@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/veertuinc/anka-prometheus-exporter/src/events"
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
+// ParseStuckThresholds parses a comma separated list of state=duration pairs, for example "Pulling=20m,Stopping=5m,Terminating=10m"
+func ParseStuckThresholds(value string) (map[string]time.Duration, error) {
+	thresholds := map[string]time.Duration{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		state, duration, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid stuck threshold %q: expected state=duration", pair)
+		}
+		state = strings.TrimSpace(state)
+		if !slices.Contains(types.InstanceStates, state) {
+			return nil, fmt.Errorf("invalid stuck threshold %q: unknown instance state %s (one of %s)", pair, state, strings.Join(types.InstanceStates, ", "))
+		}
+		threshold, err := time.ParseDuration(strings.TrimSpace(duration))
+		if err != nil {
+			return nil, fmt.Errorf("invalid stuck threshold %q: %w", pair, err)
+		}
+		if threshold <= 0 {
+			return nil, fmt.Errorf("invalid stuck threshold %q: duration must be positive", pair)
+		}
+		thresholds[state] = threshold
+	}
+	return thresholds, nil
+}
+
+type stuckInstance struct {
+	instanceID string
+	vm         types.VmData
+	duration   time.Duration
+}
+
+// stuckUpdate is a response of /api/v1/vm along with its stuck instances
+type stuckUpdate struct {
+	instances []types.Instance
+	stuck     []stuckInstance
+}
+
+// findStuck updates the clock with the instances and returns the ones in a state for longer than its threshold
+func findStuck(clock *instanceStateClock, thresholds map[string]time.Duration, instances []types.Instance, now time.Time) []stuckInstance {
+	clock.update(instances, now)
+	stuck := []stuckInstance{}
+	for _, instance := range instances {
+		threshold, ok := thresholds[instance.Vm.State]
+		if !ok {
+			continue
+		}
+		// instances already in their state on the first request are timed from their last update (ts), the best estimate we have
+		entry, ok := clock.entry(instance.InstanceID)
+		if !ok {
+			continue
+		}
+		if duration := now.Sub(entry.enteredAt); duration > threshold {
+			stuck = append(stuck, stuckInstance{instanceID: instance.InstanceID, vm: instance.Vm, duration: duration})
+		}
+	}
+	return stuck
+}
+
+type InstanceStuckMetric struct {
+	BaseAnkaMetric[*SnapshotGaugeVec]
+	feed       *feed[[]types.Instance, stuckUpdate]
+	HandleData func([]types.Instance, []stuckInstance, *prometheus.GaugeVec)
+}
+
+func (ism InstanceStuckMetric) Subscribe(bus *events.Bus) events.Subscription {
+	return ism.feed.subscribe(bus.Instances, ism.GetName(), func(update stuckUpdate) error {
+		ism.metric.Update(func(metricVec *prometheus.GaugeVec) {
+			ism.HandleData(update.instances, update.stuck, metricVec)
+		})
+		return nil
+	})
+}
+
+// countStuck sets the count of stuck instances per state and key; keys of every instance report 0 for each watched state
+func countStuck(thresholds map[string]time.Duration, instances []types.Instance, stuck []stuckInstance, metric *prometheus.GaugeVec, labels func(types.VmData) []string) {
+	counts := map[string]map[string]int{}
+	keys := map[string][]string{}
+	for _, instance := range instances {
+		values := labels(instance.Vm)
+		keys[strings.Join(values, "\x00")] = values
+	}
+	for state := range thresholds {
+		counts[state] = map[string]int{}
+		for key := range keys {
+			counts[state][key] = 0
+		}
+	}
+	for _, s := range stuck {
+		counts[s.vm.State][strings.Join(labels(s.vm), "\x00")]++
+	}
+	for state, perKey := range counts {
+		for key, count := range perKey {
+			metric.WithLabelValues(append([]string{state}, keys[key]...)...).Set(float64(count))
+		}
+	}
+}
+
+func ankaInstanceStuckMetrics(options Options) []InstanceStuckMetric {
+	metrics := []InstanceStuckMetric{
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_instance_stuck_per_node_count", "Count of Instances in a state for longer than its stuck threshold, per Node (label: state, node_uuid)", []string{"state", "node_uuid"}, events.EVENT_VM_DATA_UPDATED),
+			HandleData: func(instances []types.Instance, stuck []stuckInstance, metric *prometheus.GaugeVec) {
+				countStuck(options.StuckThresholds, instances, stuck, metric, func(vm types.VmData) []string { return []string{vm.NodeUUID} })
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_instance_stuck_per_group_count", "Count of Instances in a state for longer than its stuck threshold, per Group (label: state, group_uuid)", []string{"state", "group_uuid"}, events.EVENT_VM_DATA_UPDATED),
+			HandleData: func(instances []types.Instance, stuck []stuckInstance, metric *prometheus.GaugeVec) {
+				countStuck(options.StuckThresholds, instances, stuck, metric, func(vm types.VmData) []string { return []string{vm.GroupUUID} })
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_instance_stuck_per_template_count", "Count of Instances in a state for longer than its stuck threshold, per Template (label: state, template_uuid, template_name)", []string{"state", "template_uuid", "template_name"}, events.EVENT_VM_DATA_UPDATED),
+			HandleData: func(instances []types.Instance, stuck []stuckInstance, metric *prometheus.GaugeVec) {
+				countStuck(options.StuckThresholds, instances, stuck, metric, func(vm types.VmData) []string { return []string{vm.TemplateUUID, vm.TemplateName} })
+			},
+		},
+	}
+	if options.StuckInstancesInfo {
+		metrics = append(metrics, InstanceStuckMetric{
+			BaseAnkaMetric: newGaugeVecMetric("anka_instance_stuck_info", "Instances in a state for longer than its stuck threshold; the value is always 1 (label: instance_id, state, node_uuid, group_uuid, template_uuid, template_name)", []string{"instance_id", "state", "node_uuid", "group_uuid", "template_uuid", "template_name"}, events.EVENT_VM_DATA_UPDATED),
+			HandleData: func(instances []types.Instance, stuck []stuckInstance, metric *prometheus.GaugeVec) {
+				for _, s := range stuck {
+					metric.WithLabelValues(s.instanceID, s.vm.State, s.vm.NodeUUID, s.vm.GroupUUID, s.vm.TemplateUUID, s.vm.TemplateName).Set(1)
+				}
+			},
+		})
+	}
+	// one clock per controller: every metric handles the same stuck instances
+	clock := newInstanceStateClock()
+	stuckFeed := newFeed("instance_stuck", func(instances []types.Instance) stuckUpdate {
+		return stuckUpdate{instances: instances, stuck: findStuck(clock, options.StuckThresholds, instances, time.Now())}
+	})
+	for i := range metrics {
+		metrics[i].feed = stuckFeed
+	}
+	return metrics
+}
+
+func init() { // runs on exporter init only (updates are made with the above EventHandler; triggered by the Client)
+	AddMetrics(func(options Options) []AnkaMetric {
+		metrics := []AnkaMetric{}
+		if len(options.StuckThresholds) == 0 {
+			return metrics
+		}
+		for _, instanceStuckMetric := range ankaInstanceStuckMetrics(options) {
+			metrics = append(metrics, instanceStuckMetric)
+		}
+		return metrics
+	})
+}
@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
+func TestParseStuckThresholds(t *testing.T) {
+	tests := []struct {
+		name       string
+		value      string
+		thresholds map[string]time.Duration
+		err        bool
+	}{
+		{name: "empty", value: "", thresholds: map[string]time.Duration{}},
+		{name: "several states", value: "Pulling=20m, Stopping = 5m,", thresholds: map[string]time.Duration{"Pulling": 20 * time.Minute, "Stopping": 5 * time.Minute}},
+		{name: "missing duration", value: "Pulling", err: true},
+		{name: "unknown state", value: "Sleeping=5m", err: true},
+		{name: "invalid duration", value: "Pulling=soon", err: true},
+		{name: "zero duration", value: "Pulling=0s", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			thresholds, err := ParseStuckThresholds(test.value)
+			if (err != nil) != test.err {
+				t.Fatalf("error = %v, expected an error: %t", err, test.err)
+			}
+			if !test.err && !maps.Equal(thresholds, test.thresholds) {
+				t.Errorf("thresholds = %v, expected %v", thresholds, test.thresholds)
+			}
+		})
+	}
+}
+
+func TestFindStuck(t *testing.T) {
+	thresholds := map[string]time.Duration{"Pulling": time.Minute}
+	tests := []struct {
+		name     string
+		requests [][]types.Instance // 30 seconds apart, from clockStart
+		stuck    []string           // instance IDs stuck on the last request
+	}{
+		{
+			name:     "below the threshold",
+			requests: [][]types.Instance{{}, {clockInstance("i1", "Pulling", after(20*time.Second), nil)}, {clockInstance("i1", "Pulling", after(20*time.Second), nil)}},
+		},
+		{
+			name: "past the threshold",
+			requests: [][]types.Instance{
+				{},
+				{clockInstance("i1", "Pulling", after(20*time.Second), nil)},
+				{clockInstance("i1", "Pulling", after(20*time.Second), nil)},
+				{clockInstance("i1", "Pulling", after(20*time.Second), nil)},
+			},
+			stuck: []string{"i1"},
+		},
+		{
+			name:     "timed from ts on the first request",
+			requests: [][]types.Instance{{clockInstance("i1", "Pulling", after(-time.Hour), nil)}},
+			stuck:    []string{"i1"},
+		},
+		{
+			name: "left the state",
+			requests: [][]types.Instance{
+				{clockInstance("i1", "Pulling", after(-time.Hour), nil)},
+				{clockInstance("i1", "Started", after(20*time.Second), nil)},
+			},
+		},
+		{
+			name:     "state without a threshold",
+			requests: [][]types.Instance{{clockInstance("i1", "Stopping", after(-time.Hour), nil)}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := newInstanceStateClock()
+			var stuck []stuckInstance
+			for i, instances := range test.requests {
+				stuck = findStuck(clock, thresholds, instances, clockStart.Add(time.Duration(i)*30*time.Second))
+			}
+			ids := []string{}
+			for _, s := range stuck {
+				ids = append(ids, s.instanceID)
+			}
+			if !slices.Equal(ids, test.stuck) {
+				t.Errorf("stuck = %v, expected %v", ids, test.stuck)
+			}
+		})
+	}
+}
+
+// Every watched state reports 0 for the nodes of the instances, so alerts resolve once nothing is stuck
+func TestCountStuck(t *testing.T) {
+	thresholds := map[string]time.Duration{"Pulling": time.Minute, "Stopping": time.Minute}
+	instances := []types.Instance{
+		{InstanceID: "i1", Vm: types.VmData{State: "Pulling", NodeUUID: "n1"}},
+		{InstanceID: "i2", Vm: types.VmData{State: "Started", NodeUUID: "n2"}},
+	}
+	stuck := []stuckInstance{{instanceID: "i1", vm: instances[0].Vm}}
+	metric := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "stuck"}, []string{"state", "node_uuid"})
+	countStuck(thresholds, instances, stuck, metric, func(vm types.VmData) []string { return []string{vm.NodeUUID} })
+	expected := map[string]float64{"Pulling/n1": 1, "Pulling/n2": 0, "Stopping/n1": 0, "Stopping/n2": 0}
+	if series := testutil.CollectAndCount(metric); series != len(expected) {
+		t.Errorf("%d series, expected %d", series, len(expected))
+	}
+	for key, value := range expected {
+		state, node, _ := strings.Cut(key, "/")
+		if got := testutil.ToFloat64(metric.WithLabelValues(state, node)); got != value {
+			t.Errorf("%s = %v, expected %v", key, got, value)
+		}
+	}
+}
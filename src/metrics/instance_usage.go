@@ -0,0 +1,231 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/veertuinc/anka-prometheus-exporter/src/events"
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
+// MAX_UNOBSERVED_SECONDS caps the time charged to a state whose end the exporter didn't see: when a request notices an Instance or Node
+// left a state without telling when, the state is charged up to this long after the previous request, so outages aren't charged to it.
+const MAX_UNOBSERVED_SECONDS = 120
+
+var instanceUsageLabels = []string{"template_uuid", "template_name", "group_uuid", "arch", "node_uuid"}
+
+// instanceUsage is the time an instance spent Started between two requests, and the share of its Node's allocation it used meanwhile
+type instanceUsage struct {
+	vm            types.VmData
+	seconds       float64
+	vcpuSeconds   float64
+	vramMBSeconds float64
+	allocated     bool // false when the Node of the instance is unknown, so the vCPU and vRAM shares can't be computed
+}
+
+// instanceUsageTracker integrates the time instances spend Started, from one request to the next.
+// Missed requests don't lose the time of instances still Started: the next request covers everything since the last one that succeeded.
+// The time across a restart is never charged: the first request after one only starts integrating again.
+type instanceUsageTracker struct {
+	instances map[string]types.VmData
+	fetchedAt time.Time // zero until the first request
+	nodes     map[string]types.Node
+	lock      *sync.Mutex
+}
+
+func newInstanceUsageTracker() *instanceUsageTracker {
+	return &instanceUsageTracker{nodes: map[string]types.Node{}, lock: &sync.Mutex{}}
+}
+
+func (tracker *instanceUsageTracker) updateNodes(nodes []types.Node) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	tracker.nodes = make(map[string]types.Node, len(nodes))
+	for _, node := range nodes {
+		tracker.nodes[node.NodeID] = node
+	}
+}
+
+// update returns the usage of every instance Started at some point since the previous request
+func (tracker *instanceUsageTracker) update(instances []types.Instance, now time.Time) []instanceUsage {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	usages := []instanceUsage{}
+	current := make(map[string]types.VmData, len(instances))
+	for _, instance := range instances {
+		current[instance.InstanceID] = instance.Vm
+	}
+	if !tracker.fetchedAt.IsZero() && now.After(tracker.fetchedAt) {
+		since := tracker.fetchedAt
+		// ts is updated on state changes: when it falls between the two requests, the instance started or stopped then
+		changedAt := func(vm types.VmData) (time.Time, bool) {
+			changed := parseInstanceTime(vm.LastUpdateTime, time.Time{})
+			if changed.Before(since) || changed.After(now) {
+				return time.Time{}, false
+			}
+			return changed, true
+		}
+		for instanceID, vm := range current {
+			previous, seen := tracker.instances[instanceID]
+			wasStarted := seen && previous.State == INSTANCE_STATE_STARTED
+			isStarted := vm.State == INSTANCE_STATE_STARTED
+			var duration time.Duration
+			switch {
+			case wasStarted && isStarted:
+				duration = now.Sub(since)
+			case wasStarted:
+				stoppedAt, ok := changedAt(vm)
+				if !ok {
+					stoppedAt = unobservedEnd(since, now)
+				}
+				duration = stoppedAt.Sub(since)
+			case isStarted:
+				if startedAt, ok := changedAt(vm); ok {
+					duration = now.Sub(startedAt)
+				}
+			}
+			if duration > 0 {
+				usages = append(usages, tracker.usage(vm, duration))
+			}
+		}
+		// instances removed from the Controller were Started until some time before we noticed it
+		for instanceID, previous := range tracker.instances {
+			if _, ok := current[instanceID]; !ok && previous.State == INSTANCE_STATE_STARTED {
+				usages = append(usages, tracker.usage(previous, unobservedEnd(since, now).Sub(since)))
+			}
+		}
+	}
+	tracker.instances = current
+	tracker.fetchedAt = now
+	return usages
+}
+
+// unobservedEnd is when a state left between two requests is taken to end when nothing tells when it did: the current request,
+// or MAX_UNOBSERVED_SECONDS after the previous one if that comes first
+func unobservedEnd(since time.Time, now time.Time) time.Time {
+	if limit := since.Add(MAX_UNOBSERVED_SECONDS * time.Second); now.After(limit) {
+		return limit
+	}
+	return now
+}
+
+// usage splits the vCPU and vRAM used on the Node evenly between its instances; must be called with the lock held
+func (tracker *instanceUsageTracker) usage(vm types.VmData, duration time.Duration) instanceUsage {
+	usage := instanceUsage{vm: vm, seconds: duration.Seconds()}
+	if node, ok := tracker.nodes[vm.NodeUUID]; ok && node.VMCount > 0 {
+		usage.allocated = true
+		usage.vcpuSeconds = usage.seconds * float64(node.UsedVCPUCount) / float64(node.VMCount)
+		usage.vramMBSeconds = usage.seconds * float64(node.UsedVRAM) / float64(node.VMCount)
+	}
+	return usage
+}
+
+// restore takes the node allocations of a checkpoint; its instances are left out, as the time since they were seen spans the restart
+func (tracker *instanceUsageTracker) restore(lastSeen LastSeen) {
+	if lastSeen.NodesLoaded {
+		tracker.updateNodes(lastSeen.Nodes)
+	}
+}
+
+type subscriptions []events.Subscription
+
+func (s subscriptions) Unsubscribe() {
+	for _, subscription := range s {
+		subscription.Unsubscribe()
+	}
+}
+
+type InstanceUsageMetric struct {
+	BaseAnkaMetric[*prometheus.CounterVec]
+	tracker       *instanceUsageTracker
+	nodesFeed     *feed[[]types.Node, struct{}]
+	instancesFeed *feed[[]types.Instance, []instanceUsage]
+	HandleData    func([]instanceUsage, *prometheus.CounterVec)
+}
+
+func (ium InstanceUsageMetric) diffsRequests() {}
+
+// Subscribe follows the nodes too, for their vCPU and vRAM allocations
+func (ium InstanceUsageMetric) Subscribe(bus *events.Bus) events.Subscription {
+	return subscriptions{
+		ium.nodesFeed.subscribe(bus.Nodes, ium.GetName(), func(struct{}) error {
+			return nil
+		}),
+		ium.instancesFeed.subscribe(bus.Instances, ium.GetName(), func(usages []instanceUsage) error {
+			ium.HandleData(usages, ium.metric)
+			return nil
+		}),
+	}
+}
+
+func (ium InstanceUsageMetric) Checkpoint() ([]CounterSample, error) {
+	return counterSamples(ium.metric)
+}
+
+func (ium InstanceUsageMetric) Restore(samples []CounterSample, lastSeen LastSeen) error {
+	ium.tracker.restore(lastSeen)
+	return restoreCounterSamples(ium.metric, samples)
+}
+
+func instanceUsageLabelValues(vm types.VmData) []string {
+	return []string{vm.TemplateUUID, vm.TemplateName, vm.GroupUUID, vm.Arch, vm.NodeUUID}
+}
+
+func ankaInstanceUsageMetrics() []InstanceUsageMetric {
+	metrics := []InstanceUsageMetric{
+		{
+			BaseAnkaMetric: newCounterVecMetric("anka_instance_started_seconds_total", "Total time Instances spent Started, in instance-seconds (label: template_uuid, template_name, group_uuid, arch, node_uuid)", instanceUsageLabels, events.EVENT_VM_DATA_UPDATED),
+			HandleData: func(usages []instanceUsage, metric *prometheus.CounterVec) {
+				for _, usage := range usages {
+					metric.WithLabelValues(instanceUsageLabelValues(usage.vm)...).Add(usage.seconds)
+				}
+			},
+		},
+		{
+			BaseAnkaMetric: newCounterVecMetric("anka_instance_vcpu_seconds_total", "Total virtual CPU cores used by Started Instances over time, in vCPU-seconds; each Instance gets an even share of its Node's used vCPUs (label: template_uuid, template_name, group_uuid, arch, node_uuid)", instanceUsageLabels, events.EVENT_VM_DATA_UPDATED),
+			HandleData: func(usages []instanceUsage, metric *prometheus.CounterVec) {
+				for _, usage := range usages {
+					if usage.allocated {
+						metric.WithLabelValues(instanceUsageLabelValues(usage.vm)...).Add(usage.vcpuSeconds)
+					}
+				}
+			},
+		},
+		{
+			BaseAnkaMetric: newCounterVecMetric("anka_instance_vram_mb_seconds_total", "Total virtual RAM used by Started Instances over time, in MB-seconds; each Instance gets an even share of its Node's used vRAM (label: template_uuid, template_name, group_uuid, arch, node_uuid)", instanceUsageLabels, events.EVENT_VM_DATA_UPDATED),
+			HandleData: func(usages []instanceUsage, metric *prometheus.CounterVec) {
+				for _, usage := range usages {
+					if usage.allocated {
+						metric.WithLabelValues(instanceUsageLabelValues(usage.vm)...).Add(usage.vramMBSeconds)
+					}
+				}
+			},
+		},
+	}
+	// one tracker per controller: every counter handles the same usage
+	tracker := newInstanceUsageTracker()
+	nodesFeed := newFeed("instance_usage", func(nodes []types.Node) struct{} {
+		tracker.updateNodes(nodes)
+		return struct{}{}
+	})
+	instancesFeed := newFeed("instance_usage", func(instances []types.Instance) []instanceUsage {
+		return tracker.update(instances, time.Now())
+	})
+	for i := range metrics {
+		metrics[i].tracker = tracker
+		metrics[i].nodesFeed = nodesFeed
+		metrics[i].instancesFeed = instancesFeed
+	}
+	return metrics
+}
+
+func init() { // runs on exporter init only (updates are made with the above EventHandler; triggered by the Client)
+	AddMetrics(func(options Options) []AnkaMetric {
+		metrics := []AnkaMetric{}
+		for _, instanceUsageMetric := range ankaInstanceUsageMetrics() {
+			metrics = append(metrics, instanceUsageMetric)
+		}
+		return metrics
+	})
+}
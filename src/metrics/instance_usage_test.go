@@ -0,0 +1,173 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
+var usageStart = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// usageInstance is an instance on node n1 whose template UUID is its ID, so usages can be told apart; ts is relative to usageStart
+func usageInstance(id string, state string, ts *time.Duration) types.Instance {
+	vm := types.VmData{State: state, TemplateUUID: id, NodeUUID: "n1"}
+	if ts != nil {
+		vm.LastUpdateTime = usageStart.Add(*ts).Format(time.RFC3339)
+	}
+	return types.Instance{InstanceID: id, Vm: vm}
+}
+
+func after(d time.Duration) *time.Duration {
+	return &d
+}
+
+func usageSeconds(usages []instanceUsage) map[string]float64 {
+	seconds := map[string]float64{}
+	for _, usage := range usages {
+		seconds[usage.vm.TemplateUUID] += usage.seconds
+	}
+	return seconds
+}
+
+func TestInstanceUsageTracker(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous []types.Instance // seen by the previous request, at usageStart
+		current  []types.Instance
+		elapsed  time.Duration // since the previous request
+		seconds  map[string]float64
+	}{
+		{
+			name:     "still Started",
+			previous: []types.Instance{usageInstance("i1", INSTANCE_STATE_STARTED, nil)},
+			current:  []types.Instance{usageInstance("i1", INSTANCE_STATE_STARTED, nil)},
+			elapsed:  30 * time.Second,
+			seconds:  map[string]float64{"i1": 30},
+		},
+		{
+			name:     "still Started across an outage",
+			previous: []types.Instance{usageInstance("i1", INSTANCE_STATE_STARTED, nil)},
+			current:  []types.Instance{usageInstance("i1", INSTANCE_STATE_STARTED, nil)},
+			elapsed:  time.Hour,
+			seconds:  map[string]float64{"i1": 3600},
+		},
+		{
+			name:     "started in between",
+			previous: []types.Instance{usageInstance("i1", "Scheduling", nil)},
+			current:  []types.Instance{usageInstance("i1", INSTANCE_STATE_STARTED, after(20*time.Second))},
+			elapsed:  30 * time.Second,
+			seconds:  map[string]float64{"i1": 10},
+		},
+		{
+			name:    "new and started in between",
+			current: []types.Instance{usageInstance("i1", INSTANCE_STATE_STARTED, after(25*time.Second))},
+			elapsed: 30 * time.Second,
+			seconds: map[string]float64{"i1": 5},
+		},
+		{
+			name:    "started without a usable ts",
+			current: []types.Instance{usageInstance("i1", INSTANCE_STATE_STARTED, after(-time.Minute)), usageInstance("i2", INSTANCE_STATE_STARTED, nil)},
+			elapsed: 30 * time.Second,
+			seconds: map[string]float64{},
+		},
+		{
+			name:     "stopped in between",
+			previous: []types.Instance{usageInstance("i1", INSTANCE_STATE_STARTED, nil)},
+			current:  []types.Instance{usageInstance("i1", "Stopping", after(12*time.Second))},
+			elapsed:  30 * time.Second,
+			seconds:  map[string]float64{"i1": 12},
+		},
+		{
+			name:     "stopped without a usable ts",
+			previous: []types.Instance{usageInstance("i1", INSTANCE_STATE_STARTED, nil)},
+			current:  []types.Instance{usageInstance("i1", "Stopping", nil)},
+			elapsed:  30 * time.Second,
+			seconds:  map[string]float64{"i1": 30},
+		},
+		{
+			name:     "stopped without a usable ts during an outage",
+			previous: []types.Instance{usageInstance("i1", INSTANCE_STATE_STARTED, nil)},
+			current:  []types.Instance{usageInstance("i1", "Stopping", nil)},
+			elapsed:  time.Hour,
+			seconds:  map[string]float64{"i1": MAX_UNOBSERVED_SECONDS},
+		},
+		{
+			name:     "removed",
+			previous: []types.Instance{usageInstance("i1", INSTANCE_STATE_STARTED, nil)},
+			elapsed:  30 * time.Second,
+			seconds:  map[string]float64{"i1": 30},
+		},
+		{
+			name:     "removed during an outage",
+			previous: []types.Instance{usageInstance("i1", INSTANCE_STATE_STARTED, nil)},
+			elapsed:  time.Hour,
+			seconds:  map[string]float64{"i1": MAX_UNOBSERVED_SECONDS},
+		},
+		{
+			name:     "removed while not Started",
+			previous: []types.Instance{usageInstance("i1", "Stopped", nil)},
+			elapsed:  30 * time.Second,
+			seconds:  map[string]float64{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := newInstanceUsageTracker()
+			if usages := tracker.update(test.previous, usageStart); len(usages) != 0 {
+				t.Fatalf("the first request charged %v", usageSeconds(usages))
+			}
+			seconds := usageSeconds(tracker.update(test.current, usageStart.Add(test.elapsed)))
+			if len(seconds) != len(test.seconds) {
+				t.Fatalf("charged %v, expected %v", seconds, test.seconds)
+			}
+			for id, expected := range test.seconds {
+				if seconds[id] != expected {
+					t.Errorf("charged %v, expected %v", seconds, test.seconds)
+				}
+			}
+		})
+	}
+}
+
+func TestInstanceUsageAllocation(t *testing.T) {
+	tracker := newInstanceUsageTracker()
+	tracker.updateNodes([]types.Node{{NodeID: "n1", VMCount: 2, UsedVCPUCount: 4, UsedVRAM: 8192}})
+	started := []types.Instance{usageInstance("i1", INSTANCE_STATE_STARTED, nil), {InstanceID: "i2", Vm: types.VmData{State: INSTANCE_STATE_STARTED, NodeUUID: "unknown"}}}
+	tracker.update(started, usageStart)
+	usages := tracker.update(started, usageStart.Add(10*time.Second))
+	if len(usages) != 2 {
+		t.Fatalf("%d usages, expected 2", len(usages))
+	}
+	for _, usage := range usages {
+		switch usage.vm.NodeUUID {
+		case "n1":
+			if !usage.allocated || usage.vcpuSeconds != 20 || usage.vramMBSeconds != 40960 {
+				t.Errorf("usage on n1 = %+v, expected 20 vCPU-seconds and 40960 MB-seconds", usage)
+			}
+		default:
+			if usage.allocated {
+				t.Errorf("usage on an unknown node = %+v, expected no allocation", usage)
+			}
+		}
+	}
+}
+
+// The time between the last request before a restart and the first one after it is never charged
+func TestInstanceUsageRestore(t *testing.T) {
+	tracker := newInstanceUsageTracker()
+	tracker.restore(LastSeen{
+		Instances:       []types.Instance{usageInstance("i1", INSTANCE_STATE_STARTED, nil)},
+		InstancesLoaded: true,
+		Nodes:           []types.Node{{NodeID: "n1", VMCount: 1, UsedVCPUCount: 2}},
+		NodesLoaded:     true,
+	})
+	started := []types.Instance{usageInstance("i1", INSTANCE_STATE_STARTED, nil)}
+	if usages := tracker.update(started, usageStart.Add(time.Hour)); len(usages) != 0 {
+		t.Fatalf("the first request after a restore charged %v", usageSeconds(usages))
+	}
+	usages := tracker.update(started, usageStart.Add(time.Hour+10*time.Second))
+	if len(usages) != 1 || usages[0].seconds != 10 || usages[0].vcpuSeconds != 20 {
+		t.Fatalf("usages = %+v, expected 10 seconds and 20 vCPU-seconds with the restored node", usages)
+	}
+}
@@ -1,11 +1,32 @@
 package metrics
 
-var MetricsHolder []AnkaMetric
+import (
+	"time"
 
-func AddMetric(m AnkaMetric) {
-	if MetricsHolder == nil {
-		MetricsHolder = make([]AnkaMetric, 0)
-	}
+	"github.com/veertuinc/anka-prometheus-exporter/src/inventory"
+)
+
+// Options configures the metrics created for a controller
+type Options struct {
+	StuckThresholds    map[string]time.Duration // longest expected time in each instance state; instances over it are counted as stuck
+	StuckInstancesInfo bool                     // also expose anka_instance_stuck_info with the ID of every stuck instance
+	NodeFlapThreshold  int                      // a Node changing state more than this many times within NodeFlapWindow is flapping; defaults to DEFAULT_NODE_FLAP_THRESHOLD
+	NodeFlapWindow     time.Duration            // defaults to DEFAULT_NODE_FLAP_WINDOW_SECONDS
+	Inventory          *inventory.Inventory     // Nodes expected on the controller; the inventory metrics are only exposed when set
+}
+
+var metricsConstructors []func(Options) []AnkaMetric
 
-	MetricsHolder = append(MetricsHolder, m)
+// AddMetrics registers a constructor for a group of metrics. Constructors are used instead of single instances so that each monitored controller gets its own set of metrics.
+func AddMetrics(constructor func(Options) []AnkaMetric) {
+	metricsConstructors = append(metricsConstructors, constructor)
+}
+
+// NewMetrics creates a new instance of every registered metric
+func NewMetrics(options Options) []AnkaMetric {
+	metrics := make([]AnkaMetric, 0)
+	for _, constructor := range metricsConstructors {
+		metrics = append(metrics, constructor(options)...)
+	}
+	return metrics
 }
@@ -1,310 +1,335 @@
 package metrics
 
 import (
+	"slices"
+	"sync"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/veertuinc/anka-prometheus-exporter/src/events"
 	"github.com/veertuinc/anka-prometheus-exporter/src/types"
 )
 
-type NodeGroupMetric struct {
-	BaseAnkaMetric
-	HandleData func([]types.Node, []types.NodeGroup, *prometheus.GaugeVec)
+// nodeGroupsCache keeps the latest nodes and groups, since node group metrics are updated when either of them is fetched
+type nodeGroupsCache struct {
+	nodes        []types.Node
+	nodesLoaded  bool
+	groups       []types.NodeGroup // from /api/v1/group
+	groupsLoaded bool
+	lock         *sync.Mutex
 }
 
-func (ngm NodeGroupMetric) GetEventHandler() func(interface{}) error {
-	return func(nodesData interface{}) error {
-		nodes, err := ConvertToNodeData(nodesData)
-		if err != nil {
-			return err
-		}
-		metric, err := ConvertMetricToGaugeVec(ngm.metric)
-		if err != nil {
-			return err
-		}
-		// TODO: make an API call for all groups
-		var nodeGroups []types.NodeGroup
-		for _, node := range nodes {
-			nodeGroups = append(nodeGroups, node.Groups...)
+func newNodeGroupsCache() *nodeGroupsCache {
+	return &nodeGroupsCache{lock: &sync.Mutex{}}
+}
+
+// update stores the nodes or groups (nil values are left alone) and calls handle with every known group, unless nodes (or groups, with
+// requireGroups) were never fetched. Groups defined on the Controller come first; groups only seen on nodes are kept too, so Controllers
+// without the group API still report them.
+func (cache *nodeGroupsCache) update(nodes []types.Node, groups []types.NodeGroup, requireGroups bool, handle func([]types.Node, []types.NodeGroup)) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if nodes != nil {
+		cache.nodes = nodes
+		cache.nodesLoaded = true
+	}
+	if groups != nil {
+		cache.groups = groups
+		cache.groupsLoaded = true
+	}
+	if !cache.nodesLoaded || (requireGroups && !cache.groupsLoaded) {
+		return
+	}
+	nodeGroups := slices.Clone(cache.groups)
+	for _, node := range cache.nodes {
+		for _, group := range node.Groups {
+			if !slices.ContainsFunc(nodeGroups, func(g types.NodeGroup) bool { return g.Id == group.Id }) {
+				nodeGroups = append(nodeGroups, group)
+			}
 		}
-		nodeGroups = uniqueNodeGroupsArray(nodeGroups)
-		ngm.HandleData(
-			nodes,
-			nodeGroups,
-			metric,
-		)
+	}
+	handle(cache.nodes, nodeGroups)
+}
+
+type NodeGroupMetric struct {
+	BaseAnkaMetric[*SnapshotGaugeVec]
+	cache         *nodeGroupsCache
+	requireGroups bool // only update the metric once the groups defined on the Controller are known
+	HandleData    func([]types.Node, []types.NodeGroup, *prometheus.GaugeVec)
+}
+
+func (ngm NodeGroupMetric) Subscribe(bus *events.Bus) events.Subscription {
+	handle := func(nodes []types.Node, groups []types.NodeGroup) error {
+		ngm.cache.update(nodes, groups, ngm.requireGroups, func(nodes []types.Node, nodeGroups []types.NodeGroup) {
+			ngm.metric.Update(func(metricVec *prometheus.GaugeVec) {
+				ngm.HandleData(
+					nodes,
+					nodeGroups,
+					metricVec,
+				)
+			})
+		})
 		return nil
 	}
+	return subscriptions{
+		bus.Nodes.Subscribe(ngm.GetName(), func(nodes []types.Node) error {
+			if nodes == nil {
+				nodes = []types.Node{}
+			}
+			return handle(nodes, nil)
+		}),
+		bus.Groups.Subscribe(ngm.GetName(), func(groups []types.NodeGroup) error {
+			if groups == nil {
+				groups = []types.NodeGroup{}
+			}
+			return handle(nil, groups)
+		}),
+	}
 }
 
-var ankaNodeGroupMetrics = []NodeGroupMetric{
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetricVec("anka_node_group_nodes_count", "Count of Nodes in a particular Group", []string{"group_name"}),
-			event:  events.EVENT_NODE_UPDATED,
-		},
-		HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
-			checkAndHandleResetOfGaugeVecMetric((len(nodeGroups) + len(nodes)), "anka_node_group_nodes_count", metric)
-			for _, focusGroup := range nodeGroups { // EACH GROUP
-				counter := 0
-				for _, node := range nodes {
-					for _, nodeGroup := range node.Groups {
-						if focusGroup.Id == nodeGroup.Id {
-							counter++
+func ankaNodeGroupMetrics() []NodeGroupMetric {
+	return []NodeGroupMetric{
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_group_nodes_count", "Count of Nodes in a particular Group", []string{"group_name"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
+				for _, focusGroup := range nodeGroups { // EACH GROUP
+					counter := 0
+					for _, node := range nodes {
+						for _, nodeGroup := range node.Groups {
+							if focusGroup.Id == nodeGroup.Id {
+								counter++
+							}
 						}
 					}
+					metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(counter))
 				}
-				metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(counter))
-			}
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetricVec("anka_node_group_states_count", "Count of Groups in a particular state (labels: group, state)", []string{"group_name", "state"}),
-			event:  events.EVENT_NODE_UPDATED,
+			},
 		},
-		HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
-			checkAndHandleResetOfGaugeVecMetric((len(nodeGroups) + len(nodes)), "anka_node_group_states_count", metric)
-			for _, focusGroup := range nodeGroups { // EACH GROUP
-				for _, state := range types.NodeStates {
-					counter := 0
-					for _, node := range nodes {
-						if node.State == state {
-							for _, nodeGroup := range node.Groups {
-								if focusGroup.Id == nodeGroup.Id {
-									counter++
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_group_states_count", "Count of Groups in a particular state (labels: group, state)", []string{"group_name", "state"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
+				for _, focusGroup := range nodeGroups { // EACH GROUP
+					for _, state := range types.NodeStates {
+						counter := 0
+						for _, node := range nodes {
+							if node.State == state {
+								for _, nodeGroup := range node.Groups {
+									if focusGroup.Id == nodeGroup.Id {
+										counter++
+									}
 								}
 							}
 						}
+						metric.With(prometheus.Labels{"group_name": focusGroup.Name, "state": state}).Set(float64(counter))
 					}
-					metric.With(prometheus.Labels{"group_name": focusGroup.Name, "state": state}).Set(float64(counter))
 				}
-			}
+			},
 		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetricVec("anka_node_group_instance_capacity", "Total Instance slots (capacity) for the Group and its Nodes", []string{"group_name"}),
-			event:  events.EVENT_NODE_UPDATED,
-		},
-		HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
-			checkAndHandleResetOfGaugeVecMetric((len(nodeGroups) + len(nodes)), "anka_node_group_instance_capacity", metric)
-			for _, focusGroup := range nodeGroups { // EACH GROUP
-				var count uint
-				for _, node := range nodes {
-					for _, group := range node.Groups {
-						if group.Id == focusGroup.Id {
-							count = count + node.Capacity
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_group_instance_capacity", "Total Instance slots (capacity) for the Group and its Nodes", []string{"group_name"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
+				for _, focusGroup := range nodeGroups { // EACH GROUP
+					var count uint
+					for _, node := range nodes {
+						for _, group := range node.Groups {
+							if group.Id == focusGroup.Id {
+								count = count + node.Capacity
+							}
 						}
 					}
+					metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(count))
 				}
-				metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(count))
-			}
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetricVec("anka_node_group_instance_count", "Count of Instances slots in use for the Group (and Nodes)", []string{"group_name"}),
-			event:  events.EVENT_NODE_UPDATED,
+			},
 		},
-		HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
-			checkAndHandleResetOfGaugeVecMetric((len(nodeGroups) + len(nodes)), "anka_node_group_instance_count", metric)
-			for _, focusGroup := range nodeGroups { // EACH GROUP
-				var count uint
-				for _, node := range nodes {
-					for _, group := range node.Groups {
-						if group.Id == focusGroup.Id {
-							count = count + node.VMCount
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_group_instance_count", "Count of Instances slots in use for the Group (and Nodes)", []string{"group_name"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
+				for _, focusGroup := range nodeGroups { // EACH GROUP
+					var count uint
+					for _, node := range nodes {
+						for _, group := range node.Groups {
+							if group.Id == focusGroup.Id {
+								count = count + node.VMCount
+							}
 						}
 					}
+					metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(count))
 				}
-				metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(count))
-			}
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetricVec("anka_node_group_disk_free_space", "Amount of free disk space for the Group (and Nodes) in Bytes", []string{"group_name"}),
-			event:  events.EVENT_NODE_UPDATED,
+			},
 		},
-		HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
-			checkAndHandleResetOfGaugeVecMetric((len(nodeGroups) + len(nodes)), "anka_node_group_disk_free_space", metric)
-			for _, focusGroup := range nodeGroups { // EACH GROUP
-				var count uint
-				for _, node := range nodes {
-					for _, group := range node.Groups {
-						if group.Id == focusGroup.Id {
-							count = count + node.FreeDiskSpace
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_group_disk_free_space", "Amount of free disk space for the Group (and Nodes) in Bytes", []string{"group_name"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
+				for _, focusGroup := range nodeGroups { // EACH GROUP
+					var count uint
+					for _, node := range nodes {
+						for _, group := range node.Groups {
+							if group.Id == focusGroup.Id {
+								count = count + node.FreeDiskSpace
+							}
 						}
 					}
+					metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(count))
 				}
-				metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(count))
-			}
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetricVec("anka_node_group_disk_total_space", "Amount of total available disk space for the Group (and Nodes) in Bytes", []string{"group_name"}),
-			event:  events.EVENT_NODE_UPDATED,
+			},
 		},
-		HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
-			checkAndHandleResetOfGaugeVecMetric((len(nodeGroups) + len(nodes)), "anka_node_group_disk_total_space", metric)
-			for _, focusGroup := range nodeGroups { // EACH GROUP
-				var count uint
-				for _, node := range nodes {
-					for _, group := range node.Groups {
-						if group.Id == focusGroup.Id {
-							count = count + node.DiskSize
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_group_disk_total_space", "Amount of total available disk space for the Group (and Nodes) in Bytes", []string{"group_name"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
+				for _, focusGroup := range nodeGroups { // EACH GROUP
+					var count uint
+					for _, node := range nodes {
+						for _, group := range node.Groups {
+							if group.Id == focusGroup.Id {
+								count = count + node.DiskSize
+							}
 						}
 					}
+					metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(count))
 				}
-				metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(count))
-			}
+			},
 		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetricVec("anka_node_group_disk_anka_used_space", "Amount of disk space used by Anka for the Group (and Nodes) in Bytes", []string{"group_name"}),
-			event:  events.EVENT_NODE_UPDATED,
-		},
-		HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
-			checkAndHandleResetOfGaugeVecMetric((len(nodeGroups) + len(nodes)), "anka_node_group_disk_anka_used_space", metric)
-			for _, focusGroup := range nodeGroups { // EACH GROUP
-				var count uint
-				for _, node := range nodes {
-					for _, group := range node.Groups {
-						if group.Id == focusGroup.Id {
-							count = count + node.AnkaDiskUsage
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_group_disk_anka_used_space", "Amount of disk space used by Anka for the Group (and Nodes) in Bytes", []string{"group_name"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
+				for _, focusGroup := range nodeGroups { // EACH GROUP
+					var count uint
+					for _, node := range nodes {
+						for _, group := range node.Groups {
+							if group.Id == focusGroup.Id {
+								count = count + node.AnkaDiskUsage
+							}
 						}
 					}
+					metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(count))
 				}
-				metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(count))
-			}
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetricVec("anka_node_group_cpu_core_count", "Number of CPU Cores for the Group (and Nodes)", []string{"group_name"}),
-			event:  events.EVENT_NODE_UPDATED,
+			},
 		},
-		HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
-			checkAndHandleResetOfGaugeVecMetric((len(nodeGroups) + len(nodes)), "anka_node_group_cpu_core_count", metric)
-			for _, focusGroup := range nodeGroups { // EACH GROUP
-				var count uint
-				for _, node := range nodes {
-					for _, group := range node.Groups {
-						if group.Id == focusGroup.Id {
-							count = count + node.CPU
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_group_cpu_core_count", "Number of CPU Cores for the Group (and Nodes)", []string{"group_name"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
+				for _, focusGroup := range nodeGroups { // EACH GROUP
+					var count uint
+					for _, node := range nodes {
+						for _, group := range node.Groups {
+							if group.Id == focusGroup.Id {
+								count = count + node.CPU
+							}
 						}
 					}
+					metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(count))
 				}
-				metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(count))
-			}
+			},
 		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetricVec("anka_node_group_cpu_util", "CPU utilization for the Group (and Nodes)", []string{"group_name"}),
-			event:  events.EVENT_NODE_UPDATED,
-		},
-		HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
-			checkAndHandleResetOfGaugeVecMetric((len(nodeGroups) + len(nodes)), "anka_node_group_cpu_util", metric)
-			for _, focusGroup := range nodeGroups { // EACH GROUP
-				var count float64
-				for _, node := range nodes {
-					for _, group := range node.Groups {
-						if group.Id == focusGroup.Id {
-							count = count + node.CPUUtilization
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_group_cpu_util", "CPU utilization for the Group (and Nodes)", []string{"group_name"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
+				for _, focusGroup := range nodeGroups { // EACH GROUP
+					var count float64
+					for _, node := range nodes {
+						for _, group := range node.Groups {
+							if group.Id == focusGroup.Id {
+								count = count + node.CPUUtilization
+							}
 						}
 					}
+					metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(count)
 				}
-				metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(count)
-			}
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetricVec("anka_node_group_ram_gb", "Total RAM available for the Group (and Nodes) in GB", []string{"group_name"}),
-			event:  events.EVENT_NODE_UPDATED,
+			},
 		},
-		HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
-			checkAndHandleResetOfGaugeVecMetric((len(nodeGroups) + len(nodes)), "anka_node_group_ram_gb", metric)
-			for _, focusGroup := range nodeGroups { // EACH GROUP
-				var count uint
-				for _, node := range nodes {
-					for _, group := range node.Groups {
-						if group.Id == focusGroup.Id {
-							count = count + node.RAM
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_group_ram_gb", "Total RAM available for the Group (and Nodes) in GB", []string{"group_name"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
+				for _, focusGroup := range nodeGroups { // EACH GROUP
+					var count uint
+					for _, node := range nodes {
+						for _, group := range node.Groups {
+							if group.Id == focusGroup.Id {
+								count = count + node.RAM
+							}
 						}
 					}
+					metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(count))
 				}
-				metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(count))
-			}
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetricVec("anka_node_group_ram_util", "Total RAM utilized for the Group (and Nodes)", []string{"group_name"}),
-			event:  events.EVENT_NODE_UPDATED,
+			},
 		},
-		HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
-			checkAndHandleResetOfGaugeVecMetric((len(nodeGroups) + len(nodes)), "anka_node_group_ram_util", metric)
-			for _, focusGroup := range nodeGroups { // EACH GROUP
-				var count float64
-				for _, node := range nodes {
-					for _, group := range node.Groups {
-						if group.Id == focusGroup.Id {
-							count = count + node.RAMUtilization
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_group_ram_util", "Total RAM utilized for the Group (and Nodes)", []string{"group_name"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
+				for _, focusGroup := range nodeGroups { // EACH GROUP
+					var count float64
+					for _, node := range nodes {
+						for _, group := range node.Groups {
+							if group.Id == focusGroup.Id {
+								count = count + node.RAMUtilization
+							}
 						}
 					}
+					metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(count)
 				}
-				metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(count)
-			}
+			},
 		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetricVec("anka_node_group_used_virtual_cpu_count", "Total Used Virtual CPU cores for the Group (and Nodes)", []string{"group_name"}),
-			event:  events.EVENT_NODE_UPDATED,
-		},
-		HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
-			checkAndHandleResetOfGaugeVecMetric((len(nodeGroups) + len(nodes)), "anka_node_group_used_virtual_cpu_count", metric)
-			for _, focusGroup := range nodeGroups { // EACH GROUP
-				var count uint
-				for _, node := range nodes {
-					for _, group := range node.Groups {
-						if group.Id == focusGroup.Id {
-							count = count + node.UsedVCPUCount
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_group_used_virtual_cpu_count", "Total Used Virtual CPU cores for the Group (and Nodes)", []string{"group_name"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
+				for _, focusGroup := range nodeGroups { // EACH GROUP
+					var count uint
+					for _, node := range nodes {
+						for _, group := range node.Groups {
+							if group.Id == focusGroup.Id {
+								count = count + node.UsedVCPUCount
+							}
 						}
 					}
+					metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(count))
 				}
-				metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(count))
-			}
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetricVec("anka_node_group_used_virtual_ram_mb", "Total Used Virtual RAM for the Group (and Nodes) in MB", []string{"group_name"}),
-			event:  events.EVENT_NODE_UPDATED,
+			},
 		},
-		HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
-			checkAndHandleResetOfGaugeVecMetric((len(nodeGroups) + len(nodes)), "anka_node_group_used_virtual_ram_mb", metric)
-			for _, focusGroup := range nodeGroups { // EACH GROUP
-				var count uint
-				for _, node := range nodes {
-					for _, group := range node.Groups {
-						if group.Id == focusGroup.Id {
-							count = count + node.UsedVRAM
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_group_used_virtual_ram_mb", "Total Used Virtual RAM for the Group (and Nodes) in MB", []string{"group_name"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
+				for _, focusGroup := range nodeGroups { // EACH GROUP
+					var count uint
+					for _, node := range nodes {
+						for _, group := range node.Groups {
+							if group.Id == focusGroup.Id {
+								count = count + node.UsedVRAM
+							}
 						}
 					}
+					metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(count))
 				}
-				metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(count))
-			}
+			},
 		},
-	},
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_group_info", "Groups defined on the Controller, including the ones without Nodes; the value is always 1 (label: group_uuid, group_name, description, fallback_group_uuid, fallback_group_name)", []string{"group_uuid", "group_name", "description", "fallback_group_uuid", "fallback_group_name"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
+				names := map[string]string{}
+				for _, group := range nodeGroups {
+					names[group.Id] = group.Name
+				}
+				for _, group := range nodeGroups {
+					metric.With(prometheus.Labels{
+						"group_uuid":          group.Id,
+						"group_name":          group.Name,
+						"description":         group.Description,
+						"fallback_group_uuid": group.FallBackGroupId,
+						"fallback_group_name": names[group.FallBackGroupId],
+					}).Set(1)
+				}
+			},
+		},
+	}
 }
 
 func init() { // runs on exporter init only (updates are made with the above EventHandler; triggered by the Client)
-	for _, nodeGroupMetric := range ankaNodeGroupMetrics {
-		AddMetric(nodeGroupMetric)
-	}
+	AddMetrics(func(options Options) []AnkaMetric {
+		metrics := []AnkaMetric{}
+		// one cache per controller: every metric of the family stores the same nodes and groups
+		cache := newNodeGroupsCache()
+		for _, nodeGroupMetric := range ankaNodeGroupMetrics() {
+			nodeGroupMetric.cache = cache
+			metrics = append(metrics, nodeGroupMetric)
+		}
+		return metrics
+	})
 }
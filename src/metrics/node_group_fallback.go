@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/veertuinc/anka-prometheus-exporter/src/events"
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
+const NODE_STATE_ACTIVE = "Active"
+
+// fallbackChain is a group followed by the groups its Instances fall back to, each group once
+type fallbackChain struct {
+	groups   []types.NodeGroup
+	cycle    bool // the chain loops back to a group already in it
+	dangling bool // the chain ends on a fallback group ID that doesn't exist
+}
+
+func resolveFallbackChain(group types.NodeGroup, groupsByID map[string]types.NodeGroup) fallbackChain {
+	chain := fallbackChain{groups: []types.NodeGroup{group}}
+	visited := map[string]bool{group.Id: true}
+	for next := group.FallBackGroupId; next != ""; {
+		if visited[next] {
+			chain.cycle = true
+			break
+		}
+		fallback, ok := groupsByID[next]
+		if !ok {
+			chain.dangling = true
+			break
+		}
+		visited[next] = true
+		chain.groups = append(chain.groups, fallback)
+		next = fallback.FallBackGroupId
+	}
+	return chain
+}
+
+// nodeFreeSlots is the number of Instances the Node can still start; only Active Nodes take new Instances
+func nodeFreeSlots(node types.Node) uint {
+	if node.State != NODE_STATE_ACTIVE || node.VMCount >= node.Capacity {
+		return 0
+	}
+	return node.Capacity - node.VMCount
+}
+
+// freeSlots sums the free slots of the Nodes belonging to any of the groups; Nodes in several of them are counted once
+func freeSlots(nodes []types.Node, groups []types.NodeGroup) uint {
+	var count uint
+	for _, node := range nodes {
+		for _, nodeGroup := range node.Groups {
+			if groupsContain(groups, nodeGroup.Id) {
+				count = count + nodeFreeSlots(node)
+				break
+			}
+		}
+	}
+	return count
+}
+
+func groupsContain(groups []types.NodeGroup, groupID string) bool {
+	for _, group := range groups {
+		if group.Id == groupID {
+			return true
+		}
+	}
+	return false
+}
+
+func fallbackChains(nodeGroups []types.NodeGroup) map[string]fallbackChain {
+	groupsByID := make(map[string]types.NodeGroup, len(nodeGroups))
+	for _, group := range nodeGroups {
+		groupsByID[group.Id] = group
+	}
+	chains := make(map[string]fallbackChain, len(nodeGroups))
+	for _, group := range nodeGroups {
+		chains[group.Id] = resolveFallbackChain(group, groupsByID)
+	}
+	return chains
+}
+
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func ankaNodeGroupFallbackMetrics() []NodeGroupMetric {
+	return []NodeGroupMetric{
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_group_free_instance_slots", "Count of Instance slots still available on the Active Nodes of the Group", []string{"group_name"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
+				for _, focusGroup := range nodeGroups { // EACH GROUP
+					metric.With(prometheus.Labels{"group_name": focusGroup.Name}).Set(float64(freeSlots(nodes, []types.NodeGroup{focusGroup})))
+				}
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_group_effective_free_instance_slots", "Count of Instance slots available to the Group: its own free slots plus the ones of the groups it falls back to", []string{"group_name"}, events.EVENT_NODE_UPDATED),
+			requireGroups:  true,
+			HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
+				for _, chain := range fallbackChains(nodeGroups) {
+					metric.With(prometheus.Labels{"group_name": chain.groups[0].Name}).Set(float64(freeSlots(nodes, chain.groups)))
+				}
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_group_fallback_chain_length", "Count of groups the Instances of the Group can fall back to, directly or through other fallbacks", []string{"group_name"}, events.EVENT_NODE_UPDATED),
+			requireGroups:  true,
+			HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
+				for _, chain := range fallbackChains(nodeGroups) {
+					metric.With(prometheus.Labels{"group_name": chain.groups[0].Name}).Set(float64(len(chain.groups) - 1))
+				}
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_group_fallback_cycle", "Whether the fallback chain of the Group loops back to a group already in it", []string{"group_name"}, events.EVENT_NODE_UPDATED),
+			requireGroups:  true,
+			HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
+				for _, chain := range fallbackChains(nodeGroups) {
+					metric.With(prometheus.Labels{"group_name": chain.groups[0].Name}).Set(boolToFloat(chain.cycle))
+				}
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_group_fallback_dangling", "Whether the fallback chain of the Group ends on a fallback group that doesn't exist", []string{"group_name"}, events.EVENT_NODE_UPDATED),
+			requireGroups:  true,
+			HandleData: func(nodes []types.Node, nodeGroups []types.NodeGroup, metric *prometheus.GaugeVec) {
+				for _, chain := range fallbackChains(nodeGroups) {
+					metric.With(prometheus.Labels{"group_name": chain.groups[0].Name}).Set(boolToFloat(chain.dangling))
+				}
+			},
+		},
+	}
+}
+
+func init() { // runs on exporter init only (updates are made with the above EventHandler; triggered by the Client)
+	AddMetrics(func(options Options) []AnkaMetric {
+		metrics := []AnkaMetric{}
+		// one cache per controller: every metric of the family stores the same nodes and groups
+		cache := newNodeGroupsCache()
+		for _, nodeGroupFallbackMetric := range ankaNodeGroupFallbackMetrics() {
+			nodeGroupFallbackMetric.cache = cache
+			metrics = append(metrics, nodeGroupFallbackMetric)
+		}
+		return metrics
+	})
+}
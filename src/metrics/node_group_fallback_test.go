@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
+func TestResolveFallbackChain(t *testing.T) {
+	tests := []struct {
+		name     string
+		groups   []types.NodeGroup // the first one is resolved
+		chain    []string          // IDs of the resolved groups, in order
+		cycle    bool
+		dangling bool
+	}{
+		{
+			name:   "no fallback",
+			groups: []types.NodeGroup{{Id: "a"}},
+			chain:  []string{"a"},
+		},
+		{
+			name:   "linear chain",
+			groups: []types.NodeGroup{{Id: "a", FallBackGroupId: "b"}, {Id: "b", FallBackGroupId: "c"}, {Id: "c"}},
+			chain:  []string{"a", "b", "c"},
+		},
+		{
+			name:   "self cycle",
+			groups: []types.NodeGroup{{Id: "a", FallBackGroupId: "a"}},
+			chain:  []string{"a"},
+			cycle:  true,
+		},
+		{
+			name:   "cycle back to the group",
+			groups: []types.NodeGroup{{Id: "a", FallBackGroupId: "b"}, {Id: "b", FallBackGroupId: "c"}, {Id: "c", FallBackGroupId: "a"}},
+			chain:  []string{"a", "b", "c"},
+			cycle:  true,
+		},
+		{
+			name:   "cycle further down the chain",
+			groups: []types.NodeGroup{{Id: "a", FallBackGroupId: "b"}, {Id: "b", FallBackGroupId: "c"}, {Id: "c", FallBackGroupId: "b"}},
+			chain:  []string{"a", "b", "c"},
+			cycle:  true,
+		},
+		{
+			name:     "dangling fallback",
+			groups:   []types.NodeGroup{{Id: "a", FallBackGroupId: "missing"}},
+			chain:    []string{"a"},
+			dangling: true,
+		},
+		{
+			name:     "dangling fallback further down the chain",
+			groups:   []types.NodeGroup{{Id: "a", FallBackGroupId: "b"}, {Id: "b", FallBackGroupId: "missing"}},
+			chain:    []string{"a", "b"},
+			dangling: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			groupsByID := map[string]types.NodeGroup{}
+			for _, group := range test.groups {
+				groupsByID[group.Id] = group
+			}
+			chain := resolveFallbackChain(test.groups[0], groupsByID)
+			ids := []string{}
+			for _, group := range chain.groups {
+				ids = append(ids, group.Id)
+			}
+			if !slices.Equal(ids, test.chain) {
+				t.Errorf("chain = %v, expected %v", ids, test.chain)
+			}
+			if chain.cycle != test.cycle {
+				t.Errorf("cycle = %t, expected %t", chain.cycle, test.cycle)
+			}
+			if chain.dangling != test.dangling {
+				t.Errorf("dangling = %t, expected %t", chain.dangling, test.dangling)
+			}
+		})
+	}
+}
+
+func TestFreeSlots(t *testing.T) {
+	a := types.NodeGroup{Id: "a"}
+	b := types.NodeGroup{Id: "b"}
+	nodes := []types.Node{
+		{NodeID: "1", State: NODE_STATE_ACTIVE, Capacity: 4, VMCount: 1, Groups: []types.NodeGroup{a}},
+		{NodeID: "2", State: NODE_STATE_ACTIVE, Capacity: 2, VMCount: 0, Groups: []types.NodeGroup{a, b}},
+		{NodeID: "3", State: NODE_STATE_ACTIVE, Capacity: 2, VMCount: 3, Groups: []types.NodeGroup{b}},
+		{NodeID: "4", State: "Offline", Capacity: 8, VMCount: 0, Groups: []types.NodeGroup{b}},
+	}
+	tests := []struct {
+		name   string
+		groups []types.NodeGroup
+		slots  uint
+	}{
+		{name: "no groups", groups: nil, slots: 0},
+		{name: "one group", groups: []types.NodeGroup{a}, slots: 5},
+		{name: "over capacity and inactive nodes", groups: []types.NodeGroup{b}, slots: 2},
+		{name: "shared node counted once", groups: []types.NodeGroup{a, b}, slots: 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if slots := freeSlots(nodes, test.groups); slots != test.slots {
+				t.Errorf("freeSlots = %d, expected %d", slots, test.slots)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/veertuinc/anka-prometheus-exporter/src/events"
+	"github.com/veertuinc/anka-prometheus-exporter/src/inventory"
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
+// nodeGroupNames returns the sorted, comma separated names of the groups of a node
+func nodeGroupNames(node types.Node) string {
+	names := []string{}
+	for _, group := range uniqueNodeGroupsArray(node.Groups) {
+		names = append(names, group.Name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ",")
+}
+
+func findExpectedNode(inv *inventory.Inventory, node types.Node) (inventory.Node, bool) {
+	for _, expected := range inv.Nodes {
+		if expected.Matches(node) {
+			return expected, true
+		}
+	}
+	return inventory.Node{}, false
+}
+
+func ankaNodeInventoryMetrics(inv *inventory.Inventory) []NodeMetric {
+	return []NodeMetric{
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_inventory_missing", "Whether a Node of the expected inventory is missing from the Controller (label: id, name, arch)", []string{"id", "name", "arch"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, metric *prometheus.GaugeVec) {
+				for _, expected := range inv.Nodes {
+					missing := 1.0
+					if slices.ContainsFunc(nodes, expected.Matches) {
+						missing = 0
+					}
+					metric.With(prometheus.Labels{"id": expected.ID, "name": expected.Name, "arch": expected.Arch}).Set(missing)
+				}
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_inventory_unexpected", "Nodes registered with the Controller that are not in the expected inventory; the value is always 1 (label: id, name, arch)", []string{"id", "name", "arch"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, metric *prometheus.GaugeVec) {
+				for _, node := range nodes {
+					if _, ok := findExpectedNode(inv, node); !ok {
+						metric.With(prometheus.Labels{"id": node.NodeID, "name": node.NodeName, "arch": node.HostArch}).Set(1)
+					}
+				}
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_inventory_wrong_group", "Nodes of the expected inventory that are not in the expected groups; the value is always 1 (label: id, name, arch, expected_groups, groups)", []string{"id", "name", "arch", "expected_groups", "groups"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, metric *prometheus.GaugeVec) {
+				for _, node := range nodes {
+					expected, ok := findExpectedNode(inv, node)
+					if !ok || expected.GroupsMatch(node) {
+						continue
+					}
+					expectedGroups := slices.Clone(expected.Groups)
+					slices.Sort(expectedGroups)
+					metric.With(prometheus.Labels{"id": node.NodeID, "name": node.NodeName, "arch": node.HostArch, "expected_groups": strings.Join(expectedGroups, ","), "groups": nodeGroupNames(node)}).Set(1)
+				}
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_inventory_wrong_arch", "Nodes of the expected inventory that don't have the expected architecture; the value is always 1 (label: id, name, arch, expected_arch)", []string{"id", "name", "arch", "expected_arch"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, metric *prometheus.GaugeVec) {
+				for _, node := range nodes {
+					if expected, ok := findExpectedNode(inv, node); ok && !expected.ArchMatches(node) {
+						metric.With(prometheus.Labels{"id": node.NodeID, "name": node.NodeName, "arch": node.HostArch, "expected_arch": expected.Arch}).Set(1)
+					}
+				}
+			},
+		},
+	}
+}
+
+func init() { // runs on exporter init only (updates are made with the above EventHandler; triggered by the Client)
+	AddMetrics(func(options Options) []AnkaMetric {
+		metrics := []AnkaMetric{}
+		if options.Inventory == nil {
+			return metrics
+		}
+		for _, nodeInventoryMetric := range ankaNodeInventoryMetrics(options.Inventory) {
+			metrics = append(metrics, nodeInventoryMetric)
+		}
+		return metrics
+	})
+}
@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/veertuinc/anka-prometheus-exporter/src/inventory"
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
+// gaugeValues reads every series of the gauge, keyed by the values of the given labels joined with "/"
+func gaugeValues(t *testing.T, gauge *prometheus.GaugeVec, labels ...string) map[string]float64 {
+	t.Helper()
+	ch := make(chan prometheus.Metric)
+	go func() {
+		gauge.Collect(ch)
+		close(ch)
+	}()
+	values := map[string]float64{}
+	for m := range ch {
+		out := &dto.Metric{}
+		if err := m.Write(out); err != nil {
+			t.Fatal(err)
+		}
+		pairs := map[string]string{}
+		for _, pair := range out.GetLabel() {
+			pairs[pair.GetName()] = pair.GetValue()
+		}
+		key := []string{}
+		for _, label := range labels {
+			key = append(key, pairs[label])
+		}
+		values[strings.Join(key, "/")] = out.GetGauge().GetValue()
+	}
+	return values
+}
+
+func inventoryNode(id string, name string, arch string, groups ...string) types.Node {
+	node := types.Node{NodeID: id, NodeName: name, HostArch: arch}
+	for _, group := range groups {
+		node.Groups = append(node.Groups, types.NodeGroup{Id: "id-" + group, Name: group})
+	}
+	return node
+}
+
+func TestNodeInventory(t *testing.T) {
+	inv := &inventory.Inventory{Nodes: []inventory.Node{
+		{ID: "n1", Arch: "arm64", Groups: []string{"ci"}},
+		{Name: "mac-2"},
+		{ID: "n3", Groups: []string{"id-ci", "release"}},
+	}}
+	tests := []struct {
+		name       string
+		nodes      []types.Node
+		missing    map[string]float64 // by id/name
+		unexpected map[string]float64 // by id
+		wrongGroup map[string]float64 // by id/expected_groups/groups
+		wrongArch  map[string]float64 // by id/expected_arch
+	}{
+		{
+			name:    "no nodes",
+			missing: map[string]float64{"n1/": 1, "/mac-2": 1, "n3/": 1},
+		},
+		{
+			name:    "as expected",
+			nodes:   []types.Node{inventoryNode("n1", "mac-1", "arm64", "ci"), inventoryNode("n2", "mac-2", "amd64"), inventoryNode("n3", "mac-3", "arm64", "ci", "release")},
+			missing: map[string]float64{"n1/": 0, "/mac-2": 0, "n3/": 0},
+		},
+		{
+			name:       "unexpected node",
+			nodes:      []types.Node{inventoryNode("n1", "mac-1", "arm64", "ci"), inventoryNode("n4", "mac-4", "arm64")},
+			missing:    map[string]float64{"n1/": 0, "/mac-2": 1, "n3/": 1},
+			unexpected: map[string]float64{"n4": 1},
+		},
+		{
+			name:       "wrong groups and arch",
+			nodes:      []types.Node{inventoryNode("n1", "mac-1", "amd64", "ci", "release"), inventoryNode("n3", "mac-3", "arm64", "ci")},
+			missing:    map[string]float64{"n1/": 0, "/mac-2": 1, "n3/": 0},
+			wrongGroup: map[string]float64{"n1/ci/ci,release": 1, "n3/id-ci,release/ci": 1},
+			wrongArch:  map[string]float64{"n1/arm64": 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values := map[string]map[string]float64{}
+			labels := map[string][]string{
+				"anka_node_inventory_missing":     {"id", "name"},
+				"anka_node_inventory_unexpected":  {"id"},
+				"anka_node_inventory_wrong_group": {"id", "expected_groups", "groups"},
+				"anka_node_inventory_wrong_arch":  {"id", "expected_arch"},
+			}
+			for _, m := range ankaNodeInventoryMetrics(inv) {
+				m.metric.Update(func(metricVec *prometheus.GaugeVec) {
+					m.HandleData(test.nodes, metricVec)
+					values[m.GetName()] = gaugeValues(t, metricVec, labels[m.GetName()]...)
+				})
+			}
+			expectValues(t, "missing", values["anka_node_inventory_missing"], test.missing)
+			expectValues(t, "unexpected", values["anka_node_inventory_unexpected"], test.unexpected)
+			expectValues(t, "wrong group", values["anka_node_inventory_wrong_group"], test.wrongGroup)
+			expectValues(t, "wrong arch", values["anka_node_inventory_wrong_arch"], test.wrongArch)
+		})
+	}
+}
@@ -8,70 +8,63 @@ import (
 
 // TODO: can we make prometheus.GaugeVec support also .Gauge?
 type NodeStatesMetric struct {
-	BaseAnkaMetric
+	BaseAnkaMetric[*SnapshotGaugeVec]
 	HandleData func([]types.Node, *prometheus.GaugeVec)
 }
 
-func (nsm NodeStatesMetric) GetEventHandler() func(interface{}) error {
-	return func(d interface{}) error {
-		nodesData, err := ConvertToNodeData(d)
-		if err != nil {
-			return err
-		}
-		metric, err := ConvertMetricToGaugeVec(nsm.metric)
-		if err != nil {
-			return err
-		}
-		nsm.HandleData(
-			nodesData,
-			metric,
-		)
+func (nsm NodeStatesMetric) Subscribe(bus *events.Bus) events.Subscription {
+	return bus.Nodes.Subscribe(nsm.GetName(), func(nodesData []types.Node) error {
+		nsm.metric.Update(func(metricVec *prometheus.GaugeVec) {
+			nsm.HandleData(
+				nodesData,
+				metricVec,
+			)
+		})
 		return nil
-	}
+	})
 }
 
-var ankaNodeStatesMetrics = []NodeStatesMetric{
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetricVec("anka_node_states_count", "Count of Nodes in a particular State, per Architecture (label: arch, state)", []string{"arch", "state"}),
-			event:  events.EVENT_NODE_UPDATED,
-		},
-		HandleData: func(nodes []types.Node, metric *prometheus.GaugeVec) {
-			var archStateMap = intMapFromTwoStringSlices(types.Architectures, types.NodeStates)
-			for _, node := range nodes {
-				archStateMap[node.HostArch][node.State] = archStateMap[node.HostArch][node.State] + 1
-			}
-			for _, arch := range types.Architectures {
-				for _, state := range types.NodeStates {
-					metric.With(prometheus.Labels{"arch": arch, "state": state}).Set(float64(archStateMap[arch][state]))
+func ankaNodeStatesMetrics() []NodeStatesMetric {
+	return []NodeStatesMetric{
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_states_count", "Count of Nodes in a particular State, per Architecture (label: arch, state)", []string{"arch", "state"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, metric *prometheus.GaugeVec) {
+				var archStateMap = intMapFromTwoStringSlices(types.Architectures, types.NodeStates)
+				for _, node := range nodes {
+					archStateMap[node.HostArch][node.State] = archStateMap[node.HostArch][node.State] + 1
 				}
-			}
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetricVec("anka_node_states", "Node state (1 = current state) (label: id, name, state)", []string{"id", "name", "state"}),
-			event:  events.EVENT_NODE_UPDATED,
-		},
-		HandleData: func(nodes []types.Node, metric *prometheus.GaugeVec) {
-			checkAndHandleResetOfGaugeVecMetric(len(nodes), "anka_node_states", metric)
-			for _, node := range nodes {
-				if node.NodeName != "" {
+				for _, arch := range types.Architectures {
 					for _, state := range types.NodeStates {
-						if state == node.State {
-							metric.With(prometheus.Labels{"id": node.NodeID, "name": node.NodeName, "state": node.State}).Set(float64(1))
-						} else {
-							metric.With(prometheus.Labels{"id": node.NodeID, "name": node.NodeName, "state": state}).Set(float64(0))
+						metric.With(prometheus.Labels{"arch": arch, "state": state}).Set(float64(archStateMap[arch][state]))
+					}
+				}
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_states", "Node state (1 = current state) (label: id, name, state)", []string{"id", "name", "state"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, metric *prometheus.GaugeVec) {
+				for _, node := range nodes {
+					if node.NodeName != "" {
+						for _, state := range types.NodeStates {
+							if state == node.State {
+								metric.With(prometheus.Labels{"id": node.NodeID, "name": node.NodeName, "state": node.State}).Set(float64(1))
+							} else {
+								metric.With(prometheus.Labels{"id": node.NodeID, "name": node.NodeName, "state": state}).Set(float64(0))
+							}
 						}
 					}
 				}
-			}
+			},
 		},
-	},
+	}
 }
 
 func init() { // runs on exporter init only (updates are made with the above EventHandler; triggered by the Client)
-	for _, nodeStatesMetric := range ankaNodeStatesMetrics {
-		AddMetric(nodeStatesMetric)
-	}
+	AddMetrics(func(options Options) []AnkaMetric {
+		metrics := []AnkaMetric{}
+		for _, nodeStatesMetric := range ankaNodeStatesMetrics() {
+			metrics = append(metrics, nodeStatesMetric)
+		}
+		return metrics
+	})
 }
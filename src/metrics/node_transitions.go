@@ -0,0 +1,275 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/veertuinc/anka-prometheus-exporter/src/events"
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
+const (
+	DEFAULT_NODE_FLAP_THRESHOLD      = 3
+	DEFAULT_NODE_FLAP_WINDOW_SECONDS = 600
+)
+
+type nodeTransition struct {
+	node types.Node
+	from string
+	to   string
+}
+
+// nodeStateTime is the time a Node spent in a state between two requests
+type nodeStateTime struct {
+	node    types.Node
+	state   string
+	seconds float64
+}
+
+type nodeUpdate struct {
+	nodes       []types.Node
+	transitions []nodeTransition
+	stateTimes  []nodeStateTime
+	joined      []types.Node // registered since the previous request
+	departed    []types.Node // removed since the previous request, as last seen
+}
+
+// nodeTracker diffs consecutive /api/v1/node responses by NodeID and remembers the recent transitions of every Node.
+// Nodes have no update time, so transitions are dated when the exporter notices them.
+type nodeTracker struct {
+	nodes          map[string]types.Node // nil until the first request
+	fetchedAt      time.Time             // zero until the first request since the exporter started, so no time is accounted across a restart
+	lastTransition map[string]time.Time
+	recent         map[string][]time.Time // transitions within window, oldest first
+	window         time.Duration
+	lock           *sync.Mutex
+}
+
+func newNodeTracker(window time.Duration) *nodeTracker {
+	return &nodeTracker{
+		lastTransition: map[string]time.Time{},
+		recent:         map[string][]time.Time{},
+		window:         window,
+		lock:           &sync.Mutex{},
+	}
+}
+
+func (tracker *nodeTracker) update(nodes []types.Node, now time.Time) nodeUpdate {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	update := nodeUpdate{nodes: nodes}
+	current := make(map[string]types.Node, len(nodes))
+	for _, node := range nodes {
+		current[node.NodeID] = node
+		if tracker.nodes == nil {
+			continue
+		}
+		previous, seen := tracker.nodes[node.NodeID]
+		if !seen {
+			update.joined = append(update.joined, node)
+			continue
+		}
+		// the time since the previous request is accounted to the state seen then; when the state changed meanwhile, only up to MAX_UNOBSERVED_SECONDS
+		if !tracker.fetchedAt.IsZero() {
+			end := now
+			if previous.State != node.State {
+				end = unobservedEnd(tracker.fetchedAt, now)
+			}
+			if elapsed := end.Sub(tracker.fetchedAt); elapsed > 0 {
+				update.stateTimes = append(update.stateTimes, nodeStateTime{node: node, state: previous.State, seconds: elapsed.Seconds()})
+			}
+		}
+		if previous.State != node.State {
+			update.transitions = append(update.transitions, nodeTransition{node: node, from: previous.State, to: node.State})
+			tracker.lastTransition[node.NodeID] = now
+			tracker.recent[node.NodeID] = append(tracker.recent[node.NodeID], now)
+		}
+	}
+	for nodeID, previous := range tracker.nodes {
+		if _, ok := current[nodeID]; !ok {
+			update.departed = append(update.departed, previous)
+		}
+	}
+	for nodeID, transitions := range tracker.recent {
+		if _, ok := current[nodeID]; !ok {
+			delete(tracker.recent, nodeID)
+			delete(tracker.lastTransition, nodeID)
+			continue
+		}
+		for len(transitions) > 0 && now.Sub(transitions[0]) > tracker.window {
+			transitions = transitions[1:]
+		}
+		tracker.recent[nodeID] = transitions
+	}
+	tracker.nodes = current
+	tracker.fetchedAt = now
+	return update
+}
+
+// restore makes the next response diffed against the nodes of a checkpoint; the time since then spans the restart, so it isn't accounted
+func (tracker *nodeTracker) restore(lastSeen LastSeen) {
+	if !lastSeen.NodesLoaded {
+		return
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	tracker.nodes = make(map[string]types.Node, len(lastSeen.Nodes))
+	for _, node := range lastSeen.Nodes {
+		tracker.nodes[node.NodeID] = node
+	}
+}
+
+func (tracker *nodeTracker) lastTransitionAt(nodeID string) (time.Time, bool) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	at, ok := tracker.lastTransition[nodeID]
+	return at, ok
+}
+
+func (tracker *nodeTracker) recentTransitions(nodeID string) int {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	return len(tracker.recent[nodeID])
+}
+
+func nodeLabelValues(node types.Node, extra ...string) []string {
+	return append([]string{node.NodeID, node.NodeName, node.HostArch}, extra...)
+}
+
+type NodeTransitionCounterMetric struct {
+	BaseAnkaMetric[*prometheus.CounterVec]
+	tracker    *nodeTracker
+	feed       *feed[[]types.Node, nodeUpdate]
+	HandleData func(nodeUpdate, *prometheus.CounterVec)
+}
+
+func (ntcm NodeTransitionCounterMetric) diffsRequests() {}
+
+func (ntcm NodeTransitionCounterMetric) Subscribe(bus *events.Bus) events.Subscription {
+	return ntcm.feed.subscribe(bus.Nodes, ntcm.GetName(), func(update nodeUpdate) error {
+		ntcm.HandleData(update, ntcm.metric)
+		return nil
+	})
+}
+
+func (ntcm NodeTransitionCounterMetric) Checkpoint() ([]CounterSample, error) {
+	return counterSamples(ntcm.metric)
+}
+
+func (ntcm NodeTransitionCounterMetric) Restore(samples []CounterSample, lastSeen LastSeen) error {
+	ntcm.tracker.restore(lastSeen)
+	return restoreCounterSamples(ntcm.metric, samples)
+}
+
+type NodeTransitionGaugeMetric struct {
+	BaseAnkaMetric[*SnapshotGaugeVec]
+	tracker    *nodeTracker
+	feed       *feed[[]types.Node, nodeUpdate]
+	HandleData func(nodeUpdate, *nodeTracker, *prometheus.GaugeVec)
+}
+
+func (ntgm NodeTransitionGaugeMetric) diffsRequests() {}
+
+func (ntgm NodeTransitionGaugeMetric) Subscribe(bus *events.Bus) events.Subscription {
+	return ntgm.feed.subscribe(bus.Nodes, ntgm.GetName(), func(update nodeUpdate) error {
+		ntgm.metric.Update(func(metricVec *prometheus.GaugeVec) {
+			ntgm.HandleData(update, ntgm.tracker, metricVec)
+		})
+		return nil
+	})
+}
+
+func ankaNodeTransitionCounterMetrics() []NodeTransitionCounterMetric {
+	return []NodeTransitionCounterMetric{
+		{
+			BaseAnkaMetric: newCounterVecMetric("anka_node_state_transitions_total", "Count of Node state changes between two requests (label: id, name, arch, from, to)", []string{"id", "name", "arch", "from", "to"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(update nodeUpdate, metric *prometheus.CounterVec) {
+				for _, transition := range update.transitions {
+					metric.WithLabelValues(nodeLabelValues(transition.node, transition.from, transition.to)...).Inc()
+				}
+			},
+		},
+		{
+			BaseAnkaMetric: newCounterVecMetric("anka_node_joins_total", "Count of Nodes that registered with the Controller since the previous request (label: id, name, arch)", []string{"id", "name", "arch"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(update nodeUpdate, metric *prometheus.CounterVec) {
+				for _, node := range update.joined {
+					metric.WithLabelValues(nodeLabelValues(node)...).Inc()
+				}
+			},
+		},
+		{
+			BaseAnkaMetric: newCounterVecMetric("anka_node_departures_total", "Count of Nodes that disappeared from the Controller since the previous request (label: id, name, arch)", []string{"id", "name", "arch"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(update nodeUpdate, metric *prometheus.CounterVec) {
+				for _, node := range update.departed {
+					metric.WithLabelValues(nodeLabelValues(node)...).Inc()
+				}
+			},
+		},
+		{
+			BaseAnkaMetric: newCounterVecMetric("anka_node_state_seconds_total", "Total time Nodes spent in each state (label: id, name, arch, state)", []string{"id", "name", "arch", "state"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(update nodeUpdate, metric *prometheus.CounterVec) {
+				for _, stateTime := range update.stateTimes {
+					metric.WithLabelValues(nodeLabelValues(stateTime.node, stateTime.state)...).Add(stateTime.seconds)
+				}
+			},
+		},
+	}
+}
+
+func ankaNodeTransitionGaugeMetrics(options Options) []NodeTransitionGaugeMetric {
+	threshold := options.NodeFlapThreshold
+	if threshold <= 0 {
+		threshold = DEFAULT_NODE_FLAP_THRESHOLD
+	}
+	return []NodeTransitionGaugeMetric{
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_last_state_transition_timestamp_seconds", "Time of the last state change of the Node, as a Unix timestamp; only Nodes seen changing state since the exporter started (label: id, name, arch)", []string{"id", "name", "arch"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(update nodeUpdate, tracker *nodeTracker, metric *prometheus.GaugeVec) {
+				for _, node := range update.nodes {
+					if at, ok := tracker.lastTransitionAt(node.NodeID); ok {
+						metric.WithLabelValues(nodeLabelValues(node)...).Set(float64(at.Unix()))
+					}
+				}
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_node_flapping", "Whether the Node changed state more times than the flap threshold within the flap window (label: id, name, arch)", []string{"id", "name", "arch"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(update nodeUpdate, tracker *nodeTracker, metric *prometheus.GaugeVec) {
+				for _, node := range update.nodes {
+					flapping := 0.0
+					if tracker.recentTransitions(node.NodeID) > threshold {
+						flapping = 1
+					}
+					metric.WithLabelValues(nodeLabelValues(node)...).Set(flapping)
+				}
+			},
+		},
+	}
+}
+
+func init() { // runs on exporter init only (updates are made with the above EventHandler; triggered by the Client)
+	AddMetrics(func(options Options) []AnkaMetric {
+		metrics := []AnkaMetric{}
+		window := options.NodeFlapWindow
+		if window <= 0 {
+			window = DEFAULT_NODE_FLAP_WINDOW_SECONDS * time.Second
+		}
+		// one tracker per controller: every counter and gauge handles the same update
+		tracker := newNodeTracker(window)
+		nodeFeed := newFeed("node_transitions", func(nodes []types.Node) nodeUpdate {
+			return tracker.update(nodes, time.Now())
+		})
+		for _, nodeTransitionCounterMetric := range ankaNodeTransitionCounterMetrics() {
+			nodeTransitionCounterMetric.tracker = tracker
+			nodeTransitionCounterMetric.feed = nodeFeed
+			metrics = append(metrics, nodeTransitionCounterMetric)
+		}
+		for _, nodeTransitionGaugeMetric := range ankaNodeTransitionGaugeMetrics(options) {
+			nodeTransitionGaugeMetric.tracker = tracker
+			nodeTransitionGaugeMetric.feed = nodeFeed
+			metrics = append(metrics, nodeTransitionGaugeMetric)
+		}
+		return metrics
+	})
+}
@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
+func node(id string, state string) types.Node {
+	return types.Node{NodeID: id, State: state}
+}
+
+func nodeIDs(nodes []types.Node) []string {
+	ids := []string{}
+	for _, node := range nodes {
+		ids = append(ids, node.NodeID)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestNodeTracker(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		previous    []types.Node
+		current     []types.Node
+		elapsed     time.Duration
+		transitions []string           // from>to, by node
+		stateTimes  map[string]float64 // node/state: seconds
+		joined      []string
+		departed    []string
+	}{
+		{
+			name:       "unchanged",
+			previous:   []types.Node{node("n1", "Active")},
+			current:    []types.Node{node("n1", "Active")},
+			elapsed:    30 * time.Second,
+			stateTimes: map[string]float64{"n1/Active": 30},
+		},
+		{
+			name:       "unchanged across an outage",
+			previous:   []types.Node{node("n1", "Active")},
+			current:    []types.Node{node("n1", "Active")},
+			elapsed:    time.Hour,
+			stateTimes: map[string]float64{"n1/Active": 3600},
+		},
+		{
+			name:        "changed state",
+			previous:    []types.Node{node("n1", "Active")},
+			current:     []types.Node{node("n1", "Offline")},
+			elapsed:     30 * time.Second,
+			transitions: []string{"n1:Active>Offline"},
+			stateTimes:  map[string]float64{"n1/Active": 30},
+		},
+		{
+			name:        "changed state during an outage",
+			previous:    []types.Node{node("n1", "Active")},
+			current:     []types.Node{node("n1", "Offline")},
+			elapsed:     time.Hour,
+			transitions: []string{"n1:Active>Offline"},
+			stateTimes:  map[string]float64{"n1/Active": MAX_UNOBSERVED_SECONDS},
+		},
+		{
+			name:       "joined and departed",
+			previous:   []types.Node{node("n1", "Active"), node("n2", "Active")},
+			current:    []types.Node{node("n2", "Active"), node("n3", "Offline")},
+			elapsed:    10 * time.Second,
+			stateTimes: map[string]float64{"n2/Active": 10},
+			joined:     []string{"n3"},
+			departed:   []string{"n1"},
+		},
+		{
+			name:     "first nodes after none",
+			previous: []types.Node{},
+			current:  []types.Node{node("n1", "Active")},
+			elapsed:  10 * time.Second,
+			joined:   []string{"n1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := newNodeTracker(time.Hour)
+			if update := tracker.update(test.previous, start); len(update.transitions)+len(update.stateTimes)+len(update.joined)+len(update.departed) != 0 {
+				t.Fatalf("the first request reported %+v", update)
+			}
+			update := tracker.update(test.current, start.Add(test.elapsed))
+			transitions := []string{}
+			for _, transition := range update.transitions {
+				transitions = append(transitions, transition.node.NodeID+":"+transition.from+">"+transition.to)
+			}
+			if !slices.Equal(transitions, test.transitions) {
+				t.Errorf("transitions = %v, expected %v", transitions, test.transitions)
+			}
+			stateTimes := map[string]float64{}
+			for _, stateTime := range update.stateTimes {
+				stateTimes[stateTime.node.NodeID+"/"+stateTime.state] += stateTime.seconds
+			}
+			if len(stateTimes) != len(test.stateTimes) {
+				t.Errorf("state times = %v, expected %v", stateTimes, test.stateTimes)
+			}
+			for key, seconds := range test.stateTimes {
+				if stateTimes[key] != seconds {
+					t.Errorf("state times = %v, expected %v", stateTimes, test.stateTimes)
+				}
+			}
+			if joined := nodeIDs(update.joined); !slices.Equal(joined, test.joined) {
+				t.Errorf("joined = %v, expected %v", joined, test.joined)
+			}
+			if departed := nodeIDs(update.departed); !slices.Equal(departed, test.departed) {
+				t.Errorf("departed = %v, expected %v", departed, test.departed)
+			}
+		})
+	}
+}
+
+// After a restore, the first request is diffed against the checkpointed nodes, but the time across the restart isn't accounted
+func TestNodeTrackerRestore(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tracker := newNodeTracker(time.Hour)
+	tracker.restore(LastSeen{Nodes: []types.Node{node("n1", "Active"), node("n2", "Active")}, NodesLoaded: true})
+	update := tracker.update([]types.Node{node("n1", "Offline"), node("n3", "Active")}, start)
+	if len(update.transitions) != 1 || update.transitions[0].from != "Active" || update.transitions[0].to != "Offline" {
+		t.Errorf("transitions = %+v, expected n1 going Offline", update.transitions)
+	}
+	if joined, departed := nodeIDs(update.joined), nodeIDs(update.departed); !slices.Equal(joined, []string{"n3"}) || !slices.Equal(departed, []string{"n2"}) {
+		t.Errorf("joined %v and departed %v, expected [n3] and [n2]", joined, departed)
+	}
+	if len(update.stateTimes) != 0 {
+		t.Errorf("state times = %+v across the restart, expected none", update.stateTimes)
+	}
+	update = tracker.update([]types.Node{node("n1", "Offline"), node("n3", "Active")}, start.Add(15*time.Second))
+	if len(update.stateTimes) != 2 || update.stateTimes[0].seconds != 15 {
+		t.Errorf("state times = %+v, expected 15 seconds for both nodes", update.stateTimes)
+	}
+}
+
+func TestNodeTrackerFlapWindow(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tracker := newNodeTracker(time.Minute)
+	states := []string{"Active", "Offline", "Active", "Offline"}
+	for i, state := range states {
+		tracker.update([]types.Node{node("n1", state)}, start.Add(time.Duration(i)*10*time.Second))
+	}
+	if transitions := tracker.recentTransitions("n1"); transitions != 3 {
+		t.Fatalf("%d recent transitions, expected 3", transitions)
+	}
+	if at, ok := tracker.lastTransitionAt("n1"); !ok || !at.Equal(start.Add(30*time.Second)) {
+		t.Fatalf("last transition at %s, expected %s", at, start.Add(30*time.Second))
+	}
+	// the first two transitions leave the window
+	tracker.update([]types.Node{node("n1", "Offline")}, start.Add(85*time.Second))
+	if transitions := tracker.recentTransitions("n1"); transitions != 1 {
+		t.Fatalf("%d recent transitions, expected 1", transitions)
+	}
+	// departed nodes are forgotten
+	tracker.update([]types.Node{}, start.Add(90*time.Second))
+	if _, ok := tracker.lastTransitionAt("n1"); ok || tracker.recentTransitions("n1") != 0 {
+		t.Fatal("the transitions of a departed node are still tracked")
+	}
+}
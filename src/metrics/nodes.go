@@ -7,202 +7,168 @@ import (
 )
 
 type NodesMetric struct {
-	BaseAnkaMetric
-	HandleData func([]types.Node, prometheus.Gauge, *prometheus.GaugeVec)
+	BaseAnkaMetric[prometheus.Gauge]
+	HandleData func([]types.Node, prometheus.Gauge)
 }
 
-func (nm NodesMetric) GetEventHandler() func(interface{}) error {
-	return func(nodesData interface{}) error {
-		nodes, err := ConvertToNodeData(nodesData)
-		if err != nil {
-			return err
-		}
-		switch nm.metric.(type) {
-		case *prometheus.GaugeVec:
-			metricVec, err := ConvertMetricToGaugeVec(nm.metric)
-			if err != nil {
-				return err
-			}
-			nm.HandleData(
-				nodes,
-				nil,
-				metricVec,
-			)
-		default:
-			metric, err := ConvertMetricToGauge(nm.metric)
-			if err != nil {
-				return err
-			}
-			nm.HandleData(
-				nodes,
-				metric,
-				nil,
-			)
-		}
+func (nm NodesMetric) Subscribe(bus *events.Bus) events.Subscription {
+	return bus.Nodes.Subscribe(nm.GetName(), func(nodes []types.Node) error {
+		nm.HandleData(nodes, nm.metric)
 		return nil
-	}
+	})
 }
 
-var ankaNodesMetrics = []NodesMetric{
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetric("anka_nodes_count", "Count of total Anka Nodes"),
-			event:  events.EVENT_NODE_UPDATED,
-		},
-		HandleData: func(nodes []types.Node, metric prometheus.Gauge, metricVec *prometheus.GaugeVec) {
-			metric.Set(float64(len(nodes)))
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetric("anka_nodes_instance_count", "Count of Instance slots in use across all Nodes"),
-			event:  events.EVENT_NODE_UPDATED,
-		},
-		HandleData: func(nodes []types.Node, metric prometheus.Gauge, metricVec *prometheus.GaugeVec) {
-			var count uint
-			for _, node := range nodes { // For each node
-				count = count + node.VMCount
-			}
-			metric.Set(float64(count))
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetricVec("anka_nodes_instance_capacity", "Count of total Instance Capacity across all Nodes, per Architecture", []string{"arch"}),
-			event:  events.EVENT_NODE_UPDATED,
-		},
-		HandleData: func(nodes []types.Node, metric prometheus.Gauge, metricVec *prometheus.GaugeVec) {
-			checkAndHandleResetOfGaugeVecMetric(len(nodes), "anka_nodes_instance_capacity", metricVec)
-			var counts = make(map[string]uint)
-			for _, node := range nodes {
-				counts[node.HostArch] = counts[node.HostArch] + node.Capacity
-			}
-			for arch, count := range counts {
-				metricVec.With(prometheus.Labels{"arch": arch}).Set(float64(count))
-			}
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetric("anka_nodes_disk_free_space", "Amount of free disk space across all Nodes in Bytes"),
-			event:  events.EVENT_NODE_UPDATED,
-		},
-		HandleData: func(nodes []types.Node, metric prometheus.Gauge, metricVec *prometheus.GaugeVec) {
-			var count uint
-			for _, node := range nodes { // For each node
-				count = count + node.FreeDiskSpace
-			}
-			metric.Set(float64(count))
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetric("anka_nodes_disk_total_space", "Amount of total available disk space across all Nodes in Bytes"),
-			event:  events.EVENT_NODE_UPDATED,
-		},
-		HandleData: func(nodes []types.Node, metric prometheus.Gauge, metricVec *prometheus.GaugeVec) {
-			var count uint
-			for _, node := range nodes { // For each node
-				count = count + node.DiskSize
-			}
-			metric.Set(float64(count))
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetric("anka_nodes_disk_anka_used_space", "Amount of disk space used by Anka across all Nodes in Bytes"),
-			event:  events.EVENT_NODE_UPDATED,
-		},
-		HandleData: func(nodes []types.Node, metric prometheus.Gauge, metricVec *prometheus.GaugeVec) {
-			var count uint
-			for _, node := range nodes { // For each node
-				count = count + node.AnkaDiskUsage
-			}
-			metric.Set(float64(count))
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetric("anka_nodes_cpu_core_count", "Count of CPU Cores across all Nodes"),
-			event:  events.EVENT_NODE_UPDATED,
-		},
-		HandleData: func(nodes []types.Node, metric prometheus.Gauge, metricVec *prometheus.GaugeVec) {
-			var count uint
-			for _, node := range nodes { // For each node
-				count = count + node.CPU
-			}
-			metric.Set(float64(count))
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetric("anka_nodes_cpu_util", "Total CPU utilization across all Nodes"),
-			event:  events.EVENT_NODE_UPDATED,
-		},
-		HandleData: func(nodes []types.Node, metric prometheus.Gauge, metricVec *prometheus.GaugeVec) {
-			var count float64
-			for _, node := range nodes { // For each node
-				count = count + node.CPUUtilization
-			}
-			metric.Set(float64(count))
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetric("anka_nodes_ram_gb", "Total RAM available across all Nodes in GB"),
-			event:  events.EVENT_NODE_UPDATED,
-		},
-		HandleData: func(nodes []types.Node, metric prometheus.Gauge, metricVec *prometheus.GaugeVec) {
-			var count uint
-			for _, node := range nodes { // For each node
-				count = count + node.RAM
-			}
-			metric.Set(float64(count))
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetric("anka_nodes_ram_util", "Total RAM utilized across all Nodes"),
-			event:  events.EVENT_NODE_UPDATED,
-		},
-		HandleData: func(nodes []types.Node, metric prometheus.Gauge, metricVec *prometheus.GaugeVec) {
-			var count float64
-			for _, node := range nodes { // For each node
-				count = count + node.RAMUtilization
-			}
-			metric.Set(count)
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetric("anka_nodes_used_virtual_cpu_count", "Total Used Virtual CPU cores across all Nodes"),
-			event:  events.EVENT_NODE_UPDATED,
-		},
-		HandleData: func(nodes []types.Node, metric prometheus.Gauge, metricVec *prometheus.GaugeVec) {
-			var count uint
-			for _, node := range nodes { // For each node
-				count = count + node.UsedVCPUCount
-			}
-			metric.Set(float64(count))
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetric("anka_nodes_used_virtual_ram_mb", "Total Used Virtual RAM across all Nodes in MB"),
-			event:  events.EVENT_NODE_UPDATED,
+type NodesVecMetric struct {
+	BaseAnkaMetric[*SnapshotGaugeVec]
+	HandleData func([]types.Node, *prometheus.GaugeVec)
+}
+
+func (nvm NodesVecMetric) Subscribe(bus *events.Bus) events.Subscription {
+	return bus.Nodes.Subscribe(nvm.GetName(), func(nodes []types.Node) error {
+		nvm.metric.Update(func(metricVec *prometheus.GaugeVec) {
+			nvm.HandleData(nodes, metricVec)
+		})
+		return nil
+	})
+}
+
+func ankaNodesMetrics() []NodesMetric {
+	return []NodesMetric{
+		{
+			BaseAnkaMetric: newGaugeMetric("anka_nodes_count", "Count of total Anka Nodes", events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, metric prometheus.Gauge) {
+				metric.Set(float64(len(nodes)))
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeMetric("anka_nodes_instance_count", "Count of Instance slots in use across all Nodes", events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, metric prometheus.Gauge) {
+				var count uint
+				for _, node := range nodes { // For each node
+					count = count + node.VMCount
+				}
+				metric.Set(float64(count))
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeMetric("anka_nodes_disk_free_space", "Amount of free disk space across all Nodes in Bytes", events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, metric prometheus.Gauge) {
+				var count uint
+				for _, node := range nodes { // For each node
+					count = count + node.FreeDiskSpace
+				}
+				metric.Set(float64(count))
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeMetric("anka_nodes_disk_total_space", "Amount of total available disk space across all Nodes in Bytes", events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, metric prometheus.Gauge) {
+				var count uint
+				for _, node := range nodes { // For each node
+					count = count + node.DiskSize
+				}
+				metric.Set(float64(count))
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeMetric("anka_nodes_disk_anka_used_space", "Amount of disk space used by Anka across all Nodes in Bytes", events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, metric prometheus.Gauge) {
+				var count uint
+				for _, node := range nodes { // For each node
+					count = count + node.AnkaDiskUsage
+				}
+				metric.Set(float64(count))
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeMetric("anka_nodes_cpu_core_count", "Count of CPU Cores across all Nodes", events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, metric prometheus.Gauge) {
+				var count uint
+				for _, node := range nodes { // For each node
+					count = count + node.CPU
+				}
+				metric.Set(float64(count))
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeMetric("anka_nodes_cpu_util", "Total CPU utilization across all Nodes", events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, metric prometheus.Gauge) {
+				var count float64
+				for _, node := range nodes { // For each node
+					count = count + node.CPUUtilization
+				}
+				metric.Set(float64(count))
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeMetric("anka_nodes_ram_gb", "Total RAM available across all Nodes in GB", events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, metric prometheus.Gauge) {
+				var count uint
+				for _, node := range nodes { // For each node
+					count = count + node.RAM
+				}
+				metric.Set(float64(count))
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeMetric("anka_nodes_ram_util", "Total RAM utilized across all Nodes", events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, metric prometheus.Gauge) {
+				var count float64
+				for _, node := range nodes { // For each node
+					count = count + node.RAMUtilization
+				}
+				metric.Set(count)
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeMetric("anka_nodes_used_virtual_cpu_count", "Total Used Virtual CPU cores across all Nodes", events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, metric prometheus.Gauge) {
+				var count uint
+				for _, node := range nodes { // For each node
+					count = count + node.UsedVCPUCount
+				}
+				metric.Set(float64(count))
+			},
+		},
+		{
+			BaseAnkaMetric: newGaugeMetric("anka_nodes_used_virtual_ram_mb", "Total Used Virtual RAM across all Nodes in MB", events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, metric prometheus.Gauge) {
+				var count uint
+				for _, node := range nodes { // For each node
+					count = count + node.UsedVRAM
+				}
+				metric.Set(float64(count))
+			},
 		},
-		HandleData: func(nodes []types.Node, metric prometheus.Gauge, metricVec *prometheus.GaugeVec) {
-			var count uint
-			for _, node := range nodes { // For each node
-				count = count + node.UsedVRAM
-			}
-			metric.Set(float64(count))
+	}
+}
+
+func ankaNodesVecMetrics() []NodesVecMetric {
+	return []NodesVecMetric{
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_nodes_instance_capacity", "Count of total Instance Capacity across all Nodes, per Architecture", []string{"arch"}, events.EVENT_NODE_UPDATED),
+			HandleData: func(nodes []types.Node, metricVec *prometheus.GaugeVec) {
+				var counts = make(map[string]uint)
+				for _, node := range nodes {
+					counts[node.HostArch] = counts[node.HostArch] + node.Capacity
+				}
+				for arch, count := range counts {
+					metricVec.With(prometheus.Labels{"arch": arch}).Set(float64(count))
+				}
+			},
 		},
-	},
+	}
 }
 
 func init() { // runs on exporter init only (updates are made with the above EventHandler; triggered by the Client)
-	for _, nodesMetric := range ankaNodesMetrics {
-		AddMetric(nodesMetric)
-	}
+	AddMetrics(func(options Options) []AnkaMetric {
+		metrics := []AnkaMetric{}
+		for _, nodesMetric := range ankaNodesMetrics() {
+			metrics = append(metrics, nodesMetric)
+		}
+		for _, nodesVecMetric := range ankaNodesVecMetrics() {
+			metrics = append(metrics, nodesVecMetric)
+		}
+		return metrics
+	})
 }
@@ -7,62 +7,51 @@ import (
 )
 
 type RegistryDiskMetric struct {
-	BaseAnkaMetric
+	BaseAnkaMetric[prometheus.Gauge]
 	HandleData func(*types.RegistryDisk, prometheus.Gauge)
 }
 
-func (rdm RegistryDiskMetric) GetEventHandler() func(interface{}) error {
-	return func(d interface{}) error {
-		registryDiskData, err := ConvertToRegistryDiskData(d)
-		if err != nil {
-			return err
-		}
-		metric, err := ConvertMetricToGauge(rdm.metric)
-		if err != nil {
-			return err
-		}
+func (rdm RegistryDiskMetric) Subscribe(bus *events.Bus) events.Subscription {
+	return bus.RegistryDisk.Subscribe(rdm.GetName(), func(registryDiskData types.RegistryDisk) error {
 		rdm.HandleData(
-			registryDiskData,
-			metric,
+			&registryDiskData,
+			rdm.metric,
 		)
 		return nil
-	}
+	})
 }
 
-var ankaRegistryDiskMetrics = []RegistryDiskMetric{
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetric("anka_registry_disk_free_space", "Anka Build Cloud Registry free disk space"),
-			event:  events.EVENT_REGISTRY_DISK_DATA_UPDATED,
-		},
-		HandleData: func(registry *types.RegistryDisk, metric prometheus.Gauge) {
-			metric.Set(float64(registry.Free))
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetric("anka_registry_disk_total_space", "Anka Build Cloud Registry total disk size"),
-			event:  events.EVENT_REGISTRY_DISK_DATA_UPDATED,
+func ankaRegistryDiskMetrics() []RegistryDiskMetric {
+	return []RegistryDiskMetric{
+		{
+			BaseAnkaMetric: newGaugeMetric("anka_registry_disk_free_space", "Anka Build Cloud Registry free disk space", events.EVENT_REGISTRY_DISK_DATA_UPDATED),
+			HandleData: func(registry *types.RegistryDisk, metric prometheus.Gauge) {
+				metric.Set(float64(registry.Free))
+			},
 		},
-		HandleData: func(registry *types.RegistryDisk, metric prometheus.Gauge) {
-			metric.Set(float64(registry.Total))
+		{
+			BaseAnkaMetric: newGaugeMetric("anka_registry_disk_total_space", "Anka Build Cloud Registry total disk size", events.EVENT_REGISTRY_DISK_DATA_UPDATED),
+			HandleData: func(registry *types.RegistryDisk, metric prometheus.Gauge) {
+				metric.Set(float64(registry.Total))
+			},
 		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetric("anka_registry_disk_used_space", "Anka Build Cloud Registry used disk space"),
-			event:  events.EVENT_REGISTRY_DISK_DATA_UPDATED,
+		{
+			BaseAnkaMetric: newGaugeMetric("anka_registry_disk_used_space", "Anka Build Cloud Registry used disk space", events.EVENT_REGISTRY_DISK_DATA_UPDATED),
+			HandleData: func(registry *types.RegistryDisk, metric prometheus.Gauge) {
+				var used uint64 = 0
+				used = registry.Total - registry.Free
+				metric.Set(float64(used))
+			},
 		},
-		HandleData: func(registry *types.RegistryDisk, metric prometheus.Gauge) {
-			var used uint64 = 0
-			used = registry.Total - registry.Free
-			metric.Set(float64(used))
-		},
-	},
+	}
 }
 
 func init() {
-	for _, RegistryDiskMetric := range ankaRegistryDiskMetrics {
-		AddMetric(RegistryDiskMetric)
-	}
+	AddMetrics(func(options Options) []AnkaMetric {
+		metrics := []AnkaMetric{}
+		for _, RegistryDiskMetric := range ankaRegistryDiskMetrics() {
+			metrics = append(metrics, RegistryDiskMetric)
+		}
+		return metrics
+	})
 }
@@ -8,72 +8,60 @@ import (
 
 // TODO: can we make prometheus.GaugeVec support also .Gauge?
 type RegistryTemplateMetric struct {
-	BaseAnkaMetric
+	BaseAnkaMetric[*SnapshotGaugeVec]
 	HandleData func([]types.Template, *prometheus.GaugeVec)
 }
 
-func (rtm RegistryTemplateMetric) GetEventHandler() func(interface{}) error {
-	return func(d interface{}) error {
-		templates, err := ConvertToRegistryTemplatesData(d)
-		if err != nil {
-			return err
-		}
-		metric, err := ConvertMetricToGaugeVec(rtm.metric)
-		if err != nil {
-			return err
-		}
-		rtm.HandleData(
-			templates,
-			metric,
-		)
+func (rtm RegistryTemplateMetric) Subscribe(bus *events.Bus) events.Subscription {
+	return bus.RegistryTemplates.Subscribe(rtm.GetName(), func(templates []types.Template) error {
+		rtm.metric.Update(func(metricVec *prometheus.GaugeVec) {
+			rtm.HandleData(
+				templates,
+				metricVec,
+			)
+		})
 		return nil
-	}
+	})
 }
 
-var ankaRegistryTemplateMetrics = []RegistryTemplateMetric{
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetricVec("anka_registry_template_tags_count", "Count of Tags in the Registry for the Template", []string{"template_uuid", "template_name"}),
-			event:  events.EVENT_REGISTRY_TEMPLATES_UPDATED,
-		},
-		HandleData: func(templates []types.Template, metric *prometheus.GaugeVec) {
-			checkAndHandleResetOfGaugeVecMetric(len(templates), "anka_registry_template_tags_count", metric)
-			for _, template := range templates {
-				metric.With(prometheus.Labels{"template_uuid": template.UUID, "template_name": template.Name}).Set(float64(len(template.Tags)))
-			}
-		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetricVec("anka_registry_template_disk_used", "Total disk usage of the Template in the Registry", []string{"template_uuid", "template_name"}),
-			event:  events.EVENT_REGISTRY_TEMPLATES_UPDATED,
-		},
-		HandleData: func(templates []types.Template, metric *prometheus.GaugeVec) {
-			checkAndHandleResetOfGaugeVecMetric(len(templates), "anka_registry_template_disk_used", metric)
-			for _, template := range templates {
-				metric.With(prometheus.Labels{"template_uuid": template.UUID, "template_name": template.Name}).Set(float64(template.Size))
-			}
+func ankaRegistryTemplateMetrics() []RegistryTemplateMetric {
+	return []RegistryTemplateMetric{
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_registry_template_tags_count", "Count of Tags in the Registry for the Template", []string{"template_uuid", "template_name"}, events.EVENT_REGISTRY_TEMPLATES_UPDATED),
+			HandleData: func(templates []types.Template, metric *prometheus.GaugeVec) {
+				for _, template := range templates {
+					metric.With(prometheus.Labels{"template_uuid": template.UUID, "template_name": template.Name}).Set(float64(len(template.Tags)))
+				}
+			},
 		},
-	},
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetricVec("anka_registry_template_tag_disk_used", "Total disk used by the Template's Tag in the Registry", []string{"template_uuid", "template_name", "tag_name"}),
-			event:  events.EVENT_REGISTRY_TEMPLATES_UPDATED,
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_registry_template_disk_used", "Total disk usage of the Template in the Registry", []string{"template_uuid", "template_name"}, events.EVENT_REGISTRY_TEMPLATES_UPDATED),
+			HandleData: func(templates []types.Template, metric *prometheus.GaugeVec) {
+				for _, template := range templates {
+					metric.With(prometheus.Labels{"template_uuid": template.UUID, "template_name": template.Name}).Set(float64(template.Size))
+				}
+			},
 		},
-		HandleData: func(templates []types.Template, metric *prometheus.GaugeVec) {
-			checkAndHandleResetOfGaugeVecMetric(len(templates), "anka_registry_template_tag_disk_used", metric)
-			for _, template := range templates {
-				for _, tag := range template.Tags {
-					metric.With(prometheus.Labels{"template_uuid": template.UUID, "template_name": template.Name, "tag_name": tag.Name}).Set(float64(tag.Size))
+		{
+			BaseAnkaMetric: newGaugeVecMetric("anka_registry_template_tag_disk_used", "Total disk used by the Template's Tag in the Registry", []string{"template_uuid", "template_name", "tag_name"}, events.EVENT_REGISTRY_TEMPLATES_UPDATED),
+			HandleData: func(templates []types.Template, metric *prometheus.GaugeVec) {
+				for _, template := range templates {
+					for _, tag := range template.Tags {
+						metric.With(prometheus.Labels{"template_uuid": template.UUID, "template_name": template.Name, "tag_name": tag.Name}).Set(float64(tag.Size))
 
+					}
 				}
-			}
+			},
 		},
-	},
+	}
 }
 
 func init() { // runs on exporter init only (updates are made with the above EventHandler; triggered by the Client)
-	for _, RegistryTemplateMetric := range ankaRegistryTemplateMetrics {
-		AddMetric(RegistryTemplateMetric)
-	}
+	AddMetrics(func(options Options) []AnkaMetric {
+		metrics := []AnkaMetric{}
+		for _, RegistryTemplateMetric := range ankaRegistryTemplateMetrics() {
+			metrics = append(metrics, RegistryTemplateMetric)
+		}
+		return metrics
+	})
 }
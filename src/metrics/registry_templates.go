@@ -8,42 +8,37 @@ import (
 
 // TODO: can we make prometheus.GaugeVec support also .Gauge?
 type RegistryTemplatesMetric struct {
-	BaseAnkaMetric
+	BaseAnkaMetric[prometheus.Gauge]
 	HandleData func([]types.Template, prometheus.Gauge)
 }
 
-func (rtm RegistryTemplatesMetric) GetEventHandler() func(interface{}) error {
-	return func(d interface{}) error {
-		templates, err := ConvertToRegistryTemplatesData(d)
-		if err != nil {
-			return err
-		}
-		metric, err := ConvertMetricToGauge(rtm.metric)
-		if err != nil {
-			return err
-		}
+func (rtm RegistryTemplatesMetric) Subscribe(bus *events.Bus) events.Subscription {
+	return bus.RegistryTemplates.Subscribe(rtm.GetName(), func(templates []types.Template) error {
 		rtm.HandleData(
 			templates,
-			metric,
+			rtm.metric,
 		)
 		return nil
-	}
+	})
 }
 
-var ankaRegistryTemplatesMetrics = []RegistryTemplatesMetric{
-	{
-		BaseAnkaMetric: BaseAnkaMetric{
-			metric: CreateGaugeMetric("anka_registry_template_count", "Count of VM Templates in the Registry"),
-			event:  events.EVENT_REGISTRY_TEMPLATES_UPDATED,
-		},
-		HandleData: func(templates []types.Template, metric prometheus.Gauge) {
-			metric.Set(float64(len(templates)))
+func ankaRegistryTemplatesMetrics() []RegistryTemplatesMetric {
+	return []RegistryTemplatesMetric{
+		{
+			BaseAnkaMetric: newGaugeMetric("anka_registry_template_count", "Count of VM Templates in the Registry", events.EVENT_REGISTRY_TEMPLATES_UPDATED),
+			HandleData: func(templates []types.Template, metric prometheus.Gauge) {
+				metric.Set(float64(len(templates)))
+			},
 		},
-	},
+	}
 }
 
 func init() { // runs on exporter init only (updates are made with the above EventHandler; triggered by the Client)
-	for _, vmRegistryTemplateMetric := range ankaRegistryTemplatesMetrics {
-		AddMetric(vmRegistryTemplateMetric)
-	}
+	AddMetrics(func(options Options) []AnkaMetric {
+		metrics := []AnkaMetric{}
+		for _, vmRegistryTemplateMetric := range ankaRegistryTemplatesMetrics() {
+			metrics = append(metrics, vmRegistryTemplateMetric)
+		}
+		return metrics
+	})
 }
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SnapshotGaugeVec is a GaugeVec that is rebuilt from the latest Controller data on every update.
+// The new vector is only published once it is complete, so a scrape never sees a half-populated vector or series that no longer exist.
+type SnapshotGaugeVec struct {
+	opts    prometheus.GaugeOpts
+	labels  []string
+	current atomic.Pointer[prometheus.GaugeVec]
+}
+
+func NewSnapshotGaugeVec(opts prometheus.GaugeOpts, labels []string) *SnapshotGaugeVec {
+	sgv := &SnapshotGaugeVec{
+		opts:   opts,
+		labels: labels,
+	}
+	sgv.current.Store(prometheus.NewGaugeVec(opts, labels))
+	return sgv
+}
+
+// Update populates a new, empty vector with f and then swaps it in for the current one
+func (sgv *SnapshotGaugeVec) Update(f func(*prometheus.GaugeVec)) {
+	next := prometheus.NewGaugeVec(sgv.opts, sgv.labels)
+	f(next)
+	sgv.current.Store(next)
+}
+
+func (sgv *SnapshotGaugeVec) Describe(ch chan<- *prometheus.Desc) {
+	sgv.current.Load().Describe(ch)
+}
+
+func (sgv *SnapshotGaugeVec) Collect(ch chan<- prometheus.Metric) {
+	sgv.current.Load().Collect(ch)
+}
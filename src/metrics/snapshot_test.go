@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSnapshotGaugeVecDropsOldSeries(t *testing.T) {
+	sgv := NewSnapshotGaugeVec(prometheus.GaugeOpts{Name: "snapshot"}, []string{"state"})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(sgv)
+	updates := []map[string]float64{
+		{"Started": 2, "Scheduling": 1},
+		{"Started": 3},
+		{},
+	}
+	for _, values := range updates {
+		sgv.Update(func(metricVec *prometheus.GaugeVec) {
+			for state, value := range values {
+				metricVec.WithLabelValues(state).Set(value)
+			}
+		})
+		expectValues(t, "series", gaugeValues(t, sgv.current.Load(), "state"), values)
+		if _, err := registry.Gather(); err != nil {
+			t.Fatalf("gathering after the swap: %v", err)
+		}
+	}
+}
+
+// A scrape during an update is served the previous vector, complete
+func TestSnapshotGaugeVecScrapeDuringUpdate(t *testing.T) {
+	sgv := NewSnapshotGaugeVec(prometheus.GaugeOpts{Name: "snapshot"}, []string{"state"})
+	sgv.Update(func(metricVec *prometheus.GaugeVec) {
+		metricVec.WithLabelValues("Started").Set(1)
+		metricVec.WithLabelValues("Scheduling").Set(1)
+	})
+	populating := make(chan struct{})
+	resume := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sgv.Update(func(metricVec *prometheus.GaugeVec) {
+			metricVec.WithLabelValues("Started").Set(5)
+			close(populating)
+			<-resume
+			metricVec.WithLabelValues("Stopped").Set(5)
+		})
+	}()
+	<-populating
+	if series := testutil.CollectAndCount(sgv); series != 2 {
+		t.Errorf("%d series during the update, expected the 2 of the previous vector", series)
+	}
+	if value := testutil.ToFloat64(sgv.current.Load().WithLabelValues("Started")); value != 1 {
+		t.Errorf("Started = %v during the update, expected the previous value 1", value)
+	}
+	close(resume)
+	<-done
+	expectValues(t, "series", gaugeValues(t, sgv.current.Load(), "state"), map[string]float64{"Started": 5, "Stopped": 5})
+}
@@ -3,23 +3,63 @@ package metrics
 import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/veertuinc/anka-prometheus-exporter/src/events"
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
 )
 
 type AnkaMetric interface {
 	GetPrometheusMetric() prometheus.Collector
+	GetName() string
 	GetEvent() events.Event
-	GetEventHandler() func(interface{}) error
+	// Subscribe registers the handler populating the metric on the bus topic of its event
+	Subscribe(bus *events.Bus) events.Subscription
 }
 
-type BaseAnkaMetric struct {
+// BaseAnkaMetric holds the prometheus metric with its own type, so handlers use it without type assertions.
+// It is created by newGaugeMetric, newGaugeVecMetric, newCounterVecMetric or newHistogramVecMetric, which name both from one argument.
+type BaseAnkaMetric[M prometheus.Collector] struct {
+	name   string // of the prometheus metric; handlers and checkpoints are keyed by it
 	event  events.Event
-	metric prometheus.Collector
+	metric M
 }
 
-func (bam BaseAnkaMetric) GetEvent() events.Event {
+func (bam BaseAnkaMetric[M]) GetEvent() events.Event {
 	return bam.event
 }
 
-func (bam BaseAnkaMetric) GetPrometheusMetric() prometheus.Collector {
+func (bam BaseAnkaMetric[M]) GetPrometheusMetric() prometheus.Collector {
 	return bam.metric
 }
+
+func (bam BaseAnkaMetric[M]) GetName() string {
+	return bam.name
+}
+
+// DiffMetric is implemented by the metrics derived from the differences between consecutive requests; a single request, such as
+// a probe, can't populate them
+type DiffMetric interface {
+	AnkaMetric
+	diffsRequests()
+}
+
+// StatefulMetric is implemented by the metrics derived from the differences between requests. Their counters and the
+// resources they last saw are checkpointed, so they carry on counting after a restart instead of starting over.
+type StatefulMetric interface {
+	AnkaMetric
+	Checkpoint() ([]CounterSample, error)
+	// Restore adds the checkpointed samples to the counters and diffs the next request against lastSeen; it must be called before Subscribe
+	Restore(samples []CounterSample, lastSeen LastSeen) error
+}
+
+// CounterSample is one series of a counter, as saved in checkpoints
+type CounterSample struct {
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// LastSeen holds the resources of a Controller as of the last requests before a checkpoint
+type LastSeen struct {
+	Instances       []types.Instance `json:"instances"`
+	InstancesLoaded bool             `json:"instances_loaded"`
+	Nodes           []types.Node     `json:"nodes"`
+	NodesLoaded     bool             `json:"nodes_loaded"`
+}
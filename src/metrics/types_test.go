@@ -0,0 +1,24 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/veertuinc/anka-prometheus-exporter/src/inventory"
+)
+
+// Every metric, optional ones included, must have its own name: handlers and checkpoints are keyed by it
+func TestMetricNames(t *testing.T) {
+	options := Options{
+		StuckThresholds:    map[string]time.Duration{"Pulling": time.Minute},
+		StuckInstancesInfo: true,
+		Inventory:          &inventory.Inventory{},
+	}
+	seen := map[string]bool{}
+	for _, m := range NewMetrics(options) {
+		if seen[m.GetName()] {
+			t.Errorf("metric %s is defined twice", m.GetName())
+		}
+		seen[m.GetName()] = true
+	}
+}
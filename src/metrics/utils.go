@@ -1,12 +1,9 @@
 package metrics
 
 import (
-	"fmt"
-	"sync"
-	"sync/atomic"
-	"time"
-
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/veertuinc/anka-prometheus-exporter/src/events"
 	"github.com/veertuinc/anka-prometheus-exporter/src/types"
 )
 
@@ -54,98 +51,84 @@ func CreateGaugeMetric(name string, help string) prometheus.Gauge {
 	return m
 }
 
-func CreateGaugeMetricVec(name string, help string, labels []string) *prometheus.GaugeVec {
-	return prometheus.NewGaugeVec(
+func CreateGaugeMetricVec(name string, help string, labels []string) *SnapshotGaugeVec {
+	return NewSnapshotGaugeVec(
 		prometheus.GaugeOpts{
 			Name: name,
 			Help: help,
 		}, labels)
 }
 
-func ConvertToStatusData(d interface{}) (*types.Status, error) {
-	data, ok := d.(types.Status)
-	if !ok {
-		return nil, fmt.Errorf("could not convert incoming data to required status information. original data: %v", d)
-	}
-	return &data, nil
+func CreateCounterMetricVec(name string, help string, labels []string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: name,
+			Help: help,
+		}, labels)
 }
 
-func ConvertToNodeData(d interface{}) ([]types.Node, error) {
-	data, ok := d.([]types.Node)
-	if !ok {
-		return nil, fmt.Errorf("could not convert incoming data to required node information. original data: %v", d)
-	}
-	return data, nil
+func CreateHistogramMetricVec(name string, help string, labels []string, buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    name,
+			Help:    help,
+			Buckets: buckets,
+		}, labels)
 }
 
-func ConvertToRegistryDiskData(d interface{}) (*types.RegistryDisk, error) {
-	data, ok := d.(types.RegistryDisk)
-	if !ok {
-		return nil, fmt.Errorf("could not convert incoming data to required registry disk information. original data: %v", d)
-	}
-	return &data, nil
+func newGaugeMetric(name string, help string, event events.Event) BaseAnkaMetric[prometheus.Gauge] {
+	return BaseAnkaMetric[prometheus.Gauge]{name: name, event: event, metric: CreateGaugeMetric(name, help)}
 }
 
-func ConvertToRegistryTemplatesData(d interface{}) ([]types.Template, error) {
-	data, ok := d.([]types.Template)
-	if !ok {
-		return nil, fmt.Errorf("could not convert incoming data to required registry template information. original data: %v", d)
-	}
-	return data, nil
+func newGaugeVecMetric(name string, help string, labels []string, event events.Event) BaseAnkaMetric[*SnapshotGaugeVec] {
+	return BaseAnkaMetric[*SnapshotGaugeVec]{name: name, event: event, metric: CreateGaugeMetricVec(name, help, labels)}
 }
 
-func ConvertToInstancesData(d interface{}) ([]types.Instance, error) {
-	data, ok := d.([]types.Instance)
-	if !ok {
-		return nil, fmt.Errorf("could not convert incoming data to required instances information. original data: %v", d)
-	}
-	return data, nil
+func newCounterVecMetric(name string, help string, labels []string, event events.Event) BaseAnkaMetric[*prometheus.CounterVec] {
+	return BaseAnkaMetric[*prometheus.CounterVec]{name: name, event: event, metric: CreateCounterMetricVec(name, help, labels)}
 }
 
-func ConvertMetricToGauge(m prometheus.Collector) (prometheus.Gauge, error) {
-	data, ok := m.(prometheus.Gauge)
-	if !ok {
-		return nil, fmt.Errorf("could not convert metric to gauge type")
-	}
-	return data, nil
+func newHistogramVecMetric(name string, help string, labels []string, buckets []float64, event events.Event) BaseAnkaMetric[*prometheus.HistogramVec] {
+	return BaseAnkaMetric[*prometheus.HistogramVec]{name: name, event: event, metric: CreateHistogramMetricVec(name, help, labels, buckets)}
 }
 
-func ConvertMetricToGaugeVec(m prometheus.Collector) (*prometheus.GaugeVec, error) {
-	data, ok := m.(*prometheus.GaugeVec)
-	if !ok {
-		return nil, fmt.Errorf("could not convert metric to gauge vector type")
-	}
-	return data, nil
-}
-
-const DEFAULT_REFRESH_METRIC_SECONDS = 600
-
-var mutex = &sync.Mutex{}
-var lastRefreshTime int64
-var metricCountMap = make(map[string]int)
-
-func checkAndHandleReset(count int, metricName string) bool {
-	mutex.Lock()
-	val, ok := metricCountMap[metricName]
-	mutex.Unlock()
-	if ok { // Check if key exists
-		// Check if the count has changed OR if the lastRefreshTime is Greater Than or Eq to 10 minutes
-		if val != 0 && (count != val || (time.Now().Unix()-atomic.LoadInt64(&lastRefreshTime)) >= DEFAULT_REFRESH_METRIC_SECONDS) {
-			mutex.Lock()
-			delete(metricCountMap, metricName)
-			mutex.Unlock()
-			atomic.StoreInt64(&lastRefreshTime, time.Now().Unix())
-			return true
+// counterSamples reads every series of the counter, for checkpoints
+func counterSamples(counter *prometheus.CounterVec) ([]CounterSample, error) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		counter.Collect(ch)
+		close(ch)
+	}()
+	samples := []CounterSample{}
+	var err error
+	for m := range ch {
+		series := &dto.Metric{}
+		if writeErr := m.Write(series); writeErr != nil {
+			err = writeErr
+			continue
+		}
+		labels := make(map[string]string, len(series.GetLabel()))
+		for _, label := range series.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
 		}
+		samples = append(samples, CounterSample{Labels: labels, Value: series.GetCounter().GetValue()})
 	}
-	mutex.Lock()
-	metricCountMap[metricName] = count
-	mutex.Unlock()
-	return false
+	return samples, err
 }
 
-func checkAndHandleResetOfGaugeVecMetric(count int, metricName string, metric *prometheus.GaugeVec) {
-	if ok := checkAndHandleReset(count, metricName); ok {
-		metric.Reset()
+// restoreCounterSamples adds checkpointed samples to the counter; samples whose labels don't match the counter are skipped
+func restoreCounterSamples(counter *prometheus.CounterVec, samples []CounterSample) error {
+	var err error
+	for _, sample := range samples {
+		if sample.Value <= 0 {
+			continue
+		}
+		series, labelsErr := counter.GetMetricWith(sample.Labels)
+		if labelsErr != nil {
+			err = labelsErr
+			continue
+		}
+		series.Add(sample.Value)
 	}
+	return err
 }
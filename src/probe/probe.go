@@ -0,0 +1,157 @@
+package probe
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/veertuinc/anka-prometheus-exporter/src/client"
+	"github.com/veertuinc/anka-prometheus-exporter/src/config"
+	"github.com/veertuinc/anka-prometheus-exporter/src/events"
+	"github.com/veertuinc/anka-prometheus-exporter/src/log"
+	"github.com/veertuinc/anka-prometheus-exporter/src/metrics"
+	"github.com/veertuinc/anka-prometheus-exporter/src/server"
+)
+
+// PROBE_MAX_URL_TARGETS bounds the communicators kept for targets given as URLs rather than configured controllers
+const PROBE_MAX_URL_TARGETS = 32
+
+// urlTarget is a communicator kept for a URL target, with the time it was last probed for eviction
+type urlTarget struct {
+	comm     *client.Communicator
+	lastUsed time.Time
+}
+
+// Prober serves blackbox-style /probe requests: data for the target is fetched when the probe is requested and only that target's metrics are returned
+type Prober struct {
+	config      *config.Config
+	httpOptions client.HTTPOptions
+	metrics     metrics.Options
+	controllers map[string]*client.Communicator // configured controllers, by name
+	urlTargets  map[string]*urlTarget           // by address and module; the least recently probed is evicted past PROBE_MAX_URL_TARGETS
+	lock        *sync.Mutex
+}
+
+func NewProber(cfg *config.Config, httpOptions client.HTTPOptions, metricsOptions metrics.Options) *Prober {
+	return &Prober{
+		config:      cfg,
+		httpOptions: httpOptions,
+		metrics:     metricsOptions,
+		controllers: make(map[string]*client.Communicator),
+		urlTargets:  make(map[string]*urlTarget),
+		lock:        &sync.Mutex{},
+	}
+}
+
+// Probe fetches every data source of the target and returns a registry populated with its metrics. The target is either the name (or address) of a configured controller or a Controller URL; module selects the auth/TLS settings to use for a URL.
+func (prober *Prober) Probe(ctx context.Context, target, module string) (*prometheus.Registry, error) {
+	if target == "" {
+		return nil, fmt.Errorf("target parameter is missing")
+	}
+	controller, configured, err := prober.resolve(target, module)
+	if err != nil {
+		return nil, err
+	}
+	comm, err := prober.getCommunicator(ctx, controller, configured, module)
+	if err != nil {
+		return nil, err
+	}
+
+	registry := prometheus.NewRegistry()
+	controllerRegistry := prometheus.WrapRegistererWith(prometheus.Labels{"controller": controller.Name}, registry)
+	probeSuccess := metrics.CreateGaugeMetric("anka_probe_success", "Whether every data source of the probed Controller was fetched successfully")
+	probeDuration := metrics.CreateGaugeMetric("anka_probe_duration_seconds", "How long the probe of the Controller took in seconds")
+	controllerRegistry.MustRegister(probeSuccess, probeDuration)
+	controllerRegistry.MustRegister(comm.Collectors()...)
+
+	bus := events.NewBus(controller.Name)
+	controllerRegistry.MustRegister(bus.Collectors()...)
+	metricsOptions := prober.metrics
+	metricsOptions.Inventory = metricsOptions.Inventory.ForController(controller.Name)
+	for _, m := range metrics.NewMetrics(metricsOptions) {
+		if _, ok := m.(metrics.DiffMetric); ok {
+			// a probe makes a single request per data source, so these would be empty or misleading (a Node never seen flapping)
+			continue
+		}
+		if err := controllerRegistry.Register(m.GetPrometheusMetric()); err != nil {
+			return nil, fmt.Errorf("%w: registering %s: %v", server.ErrProbeInternal, m.GetName(), err)
+		}
+		m.Subscribe(bus)
+	}
+
+	start := time.Now()
+	success := 1.0
+	for _, dataSource := range comm.DataSources(bus) {
+		if err := dataSource.Refresh(ctx); err != nil {
+			log.Error(fmt.Sprintf("[probe::%s] could not get data: %+v", controller.Name, err))
+			success = 0
+		}
+	}
+	probeDuration.Set(time.Since(start).Seconds())
+	probeSuccess.Set(success)
+
+	return registry, nil
+}
+
+// resolve returns the target's controller and whether it is one of the configured controllers
+func (prober *Prober) resolve(target, module string) (config.Controller, bool, error) {
+	if module == "" {
+		if controller, ok := prober.config.FindController(target); ok {
+			return controller, true, nil
+		}
+		return config.Controller{Name: target, Address: target}, false, nil
+	}
+	m, ok := prober.config.Modules[module]
+	if !ok {
+		return config.Controller{}, false, fmt.Errorf("unknown module %s", module)
+	}
+	return config.Controller{Name: target, Address: target, Module: m}, false, nil
+}
+
+// Communicators are kept between probes so UAK sessions and registry template tags don't have to be fetched on every probe.
+// Anyone reaching /probe picks the URL targets, so only the most recently probed ones are kept.
+func (prober *Prober) getCommunicator(ctx context.Context, controller config.Controller, configured bool, module string) (*client.Communicator, error) {
+	prober.lock.Lock()
+	defer prober.lock.Unlock()
+	if configured {
+		if comm, ok := prober.controllers[controller.Name]; ok {
+			return comm, nil
+		}
+	}
+	key := controller.Address + "|" + module
+	if target, ok := prober.urlTargets[key]; ok && !configured {
+		target.lastUsed = time.Now()
+		return target.comm, nil
+	}
+	comm, err := client.NewCommunicator(controller.Address, controller.Username, controller.Password, controller.ClientTLSCerts(), prober.httpOptions, controller.ClientUAK())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create communicator for %s: %v", controller.Address, err)
+	}
+	comm.Connect(ctx)
+	if configured {
+		prober.controllers[controller.Name] = comm
+		return comm, nil
+	}
+	if len(prober.urlTargets) >= PROBE_MAX_URL_TARGETS {
+		prober.evictLeastRecentlyUsed()
+	}
+	prober.urlTargets[key] = &urlTarget{comm: comm, lastUsed: time.Now()}
+	return comm, nil
+}
+
+// must be called with the lock held
+func (prober *Prober) evictLeastRecentlyUsed() {
+	oldestKey := ""
+	var oldest time.Time
+	for key, target := range prober.urlTargets {
+		if oldestKey == "" || target.lastUsed.Before(oldest) {
+			oldestKey, oldest = key, target.lastUsed
+		}
+	}
+	if target, ok := prober.urlTargets[oldestKey]; ok {
+		target.comm.CloseIdleConnections()
+		delete(prober.urlTargets, oldestKey)
+	}
+}
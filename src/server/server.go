@@ -1,10 +1,12 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
 	"net/http"
-	"os"
+	"strconv"
 	"sync"
 	"time"
 
@@ -14,11 +16,19 @@ import (
 	"github.com/veertuinc/anka-prometheus-exporter/src/log"
 )
 
+// SCRAPE_TIMEOUT_OFFSET is kept from the scrape timeout announced by Prometheus to serve the metrics once the data is refreshed
+const SCRAPE_TIMEOUT_OFFSET = 500 * time.Millisecond
+
+// ErrProbeInternal is wrapped by the errors of probes that failed on the exporter's side; other probe errors are blamed on the request
+var ErrProbeInternal = errors.New("internal error")
+
 type Server struct {
 	lastInterval       int64
 	lastRequestTime    int64
 	registry           *prometheus.Registry
 	intervalChangeFunc func(i int64)
+	scrapeFunc         func(ctx context.Context)
+	probeFunc          func(ctx context.Context, target, module string) (*prometheus.Registry, error)
 	lock               *sync.Mutex
 	webListenAddress   string
 	version            string
@@ -43,10 +53,10 @@ func NewServer(
 	}
 }
 
-func (server *Server) Init() {
-	log.Info(fmt.Sprintf("Serving metrics at %s/metrics", server.webListenAddress))
-
-	http.HandleFunc("/metrics", server.handleRequest())
+// Handler returns the /metrics, /probe and landing page handlers on a dedicated mux, so several servers can coexist in one process
+func (server *Server) Handler() (http.Handler, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", server.handleRequest())
 
 	landingConfig := web.LandingConfig{
 		HeaderColor: "#7e57c2",
@@ -60,20 +70,49 @@ func (server *Server) Init() {
 			},
 		},
 	}
+	if server.probeFunc != nil {
+		mux.HandleFunc("/probe", server.handleProbe())
+		landingConfig.Links = append(landingConfig.Links, web.LandingLinks{
+			Address:     "/probe",
+			Text:        "Probe",
+			Description: "Metrics of a single Controller fetched at scrape time (/probe?target={controller URL or name}&module={module})",
+		})
+	}
 	landingPage, err := web.NewLandingPage(landingConfig)
 	if err != nil {
-		log.Error(fmt.Sprintf("Error creating landing page: %s", err.Error()))
-		os.Exit(1)
+		return nil, fmt.Errorf("creating landing page: %w", err)
+	}
+	mux.Handle("/", landingPage)
+	return mux, nil
+}
+
+// Serve listens on the web listen address until ctx is done, then waits until shutdownCtx is done for the requests in flight to complete
+func (server *Server) Serve(ctx context.Context, shutdownCtx context.Context, handler http.Handler) error {
+	log.Info(fmt.Sprintf("Serving metrics at %s/metrics", server.webListenAddress))
+	if server.probeFunc != nil {
+		log.Info(fmt.Sprintf("Serving probes at %s/probe?target={controller}", server.webListenAddress))
 	}
-	http.Handle("/", landingPage)
 
-	if err := web.ListenAndServe(&http.Server{}, &web.FlagConfig{
+	httpServer := &http.Server{Handler: handler}
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		log.Info("Shutting down web server")
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Warn(fmt.Sprintf("Requests still in flight at the shutdown deadline, closing their connections: %s", err.Error()))
+			httpServer.Close()
+		}
+	}()
+	err := web.ListenAndServe(httpServer, &web.FlagConfig{
 		WebListenAddresses: &[]string{server.webListenAddress},
 		WebConfigFile:      &server.configFile,
-	}, log.Logger); err != nil {
-		log.Error(fmt.Sprintf("Error starting web server: %s", err.Error()))
-		os.Exit(1)
+	}, log.Logger)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("starting web server: %w", err)
 	}
+	<-drained
+	return nil
 }
 
 func (server *Server) handleRequest() func(http.ResponseWriter, *http.Request) {
@@ -83,10 +122,47 @@ func (server *Server) handleRequest() func(http.ResponseWriter, *http.Request) {
 		if server.intervalChangeFunc != nil {
 			go server.handleInterval()
 		}
+		if server.scrapeFunc != nil {
+			ctx, cancel := scrapeContext(r)
+			server.scrapeFunc(ctx)
+			cancel()
+		}
 		handler.ServeHTTP(w, r)
 	}
 }
 
+// scrapeContext bounds the context of a scrape by the timeout Prometheus sends in the X-Prometheus-Scrape-Timeout-Seconds header
+func scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	seconds, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || seconds <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > 2*SCRAPE_TIMEOUT_OFFSET {
+		timeout -= SCRAPE_TIMEOUT_OFFSET
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+func (server *Server) handleProbe() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		ctx, cancel := scrapeContext(r)
+		defer cancel()
+		registry, err := server.probeFunc(ctx, params.Get("target"), params.Get("module"))
+		if err != nil {
+			log.Error(fmt.Sprintf("Error probing %s: %s", params.Get("target"), err.Error()))
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrProbeInternal) {
+				status = http.StatusInternalServerError
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
+
 func (server *Server) handleInterval() {
 	server.lock.Lock()
 	defer server.lock.Unlock()
@@ -106,3 +182,16 @@ func (server *Server) SetIntervalUpdateFunc(f func(i int64)) {
 		server.intervalChangeFunc = f
 	}
 }
+
+// SetScrapeFunc sets a function called before /metrics is served, with the scrape's context
+func (server *Server) SetScrapeFunc(f func(ctx context.Context)) {
+	if f != nil {
+		server.scrapeFunc = f
+	}
+}
+
+func (server *Server) SetProbeFunc(f func(ctx context.Context, target, module string) (*prometheus.Registry, error)) {
+	if f != nil {
+		server.probeFunc = f
+	}
+}
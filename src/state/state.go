@@ -1,40 +1,200 @@
 package state
 
 import (
+	"reflect"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/veertuinc/anka-prometheus-exporter/src/types"
 )
 
-var lock = &sync.Mutex{}
+const (
+	RESOURCE_STATUS             = "status"
+	RESOURCE_NODES              = "nodes"
+	RESOURCE_INSTANCES          = "vms"
+	RESOURCE_REGISTRY_DISK      = "registry_disk"
+	RESOURCE_REGISTRY_TEMPLATES = "registry_templates"
+	RESOURCE_GROUPS             = "groups"
+)
 
-type State struct {
-	TemplatesMap map[string]types.Template
+// Snapshot is an immutable view of every resource of a Controller. Every update publishes a new Snapshot with a higher Version;
+// a Snapshot (and the slices and maps it holds) must never be modified.
+type Snapshot struct {
+	Version      uint64
+	Time         time.Time
+	Status       *types.Status // nil until the first fetch
+	Nodes        []types.Node
+	Instances    []types.Instance
+	RegistryDisk *types.RegistryDisk // nil until the first fetch
+	Templates    map[string]types.Template
+	Groups       []types.NodeGroup
+	updated      map[string]time.Time
 }
 
-var once sync.Once
+// Loaded reports whether the resource was fetched at least once
+func (snapshot *Snapshot) Loaded(resource string) bool {
+	return !snapshot.updated[resource].IsZero()
+}
 
-var state *State
+// UpdatedAt returns when the resource was last fetched; zero if it never was
+func (snapshot *Snapshot) UpdatedAt(resource string) time.Time {
+	return snapshot.updated[resource]
+}
 
-func GetState() *State {
-	once.Do(func() {
-		state = &State{
-			TemplatesMap: make(map[string]types.Template),
-		}
+// Diff describes the update of one resource. Added, Removed and Updated hold the ids of the nodes, instances or templates
+// concerned; they are empty for status and registry disk updates and for the first update of a resource.
+type Diff struct {
+	Resource string
+	Previous *Snapshot
+	Current  *Snapshot
+	Added    []string
+	Removed  []string
+	Updated  []string
+}
+
+// State stores the resources of one Controller; each controller keeps its own State so data from one controller never leaks into another's metrics
+type State struct {
+	current     atomic.Pointer[Snapshot]
+	subscribers map[uint64]func(Diff)
+	nextID      uint64
+	lock        *sync.Mutex // serializes updates, so subscribers see the diffs in version order
+}
+
+func NewState() *State {
+	state := &State{
+		subscribers: make(map[uint64]func(Diff)),
+		lock:        &sync.Mutex{},
+	}
+	state.current.Store(&Snapshot{
+		Templates: map[string]types.Template{},
+		updated:   map[string]time.Time{},
 	})
 	return state
 }
 
-func (state *State) GetTemplatesMap() map[string]types.Template {
-	lock.Lock()
-	defer lock.Unlock()
-	return state.TemplatesMap
+// Snapshot returns the latest snapshot without blocking writers
+func (state *State) Snapshot() *Snapshot {
+	return state.current.Load()
+}
+
+// Subscribe calls handler with the diff of every update, in version order. Handlers run while the update is committed,
+// so they must be quick and must not update the State themselves.
+func (state *State) Subscribe(handler func(Diff)) (unsubscribe func()) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.nextID++
+	id := state.nextID
+	state.subscribers[id] = handler
+	return func() {
+		state.lock.Lock()
+		defer state.lock.Unlock()
+		delete(state.subscribers, id)
+	}
+}
+
+func (state *State) SetStatus(status types.Status) {
+	state.update(RESOURCE_STATUS, func(next *Snapshot) { next.Status = &status }, nil)
+}
+
+func (state *State) SetNodes(nodes []types.Node) {
+	nodes = slices.Clone(nodes)
+	state.update(RESOURCE_NODES, func(next *Snapshot) { next.Nodes = nodes }, func(previous, current *Snapshot) (map[string]any, map[string]any) {
+		return keyed(previous.Nodes, func(n types.Node) string { return n.NodeID }), keyed(current.Nodes, func(n types.Node) string { return n.NodeID })
+	})
+}
+
+func (state *State) SetInstances(instances []types.Instance) {
+	instances = slices.Clone(instances)
+	state.update(RESOURCE_INSTANCES, func(next *Snapshot) { next.Instances = instances }, func(previous, current *Snapshot) (map[string]any, map[string]any) {
+		return keyed(previous.Instances, func(i types.Instance) string { return i.InstanceID }), keyed(current.Instances, func(i types.Instance) string { return i.InstanceID })
+	})
 }
 
-func (state *State) SetTemplatesMap(templates []types.Template) {
-	lock.Lock()
-	defer lock.Unlock()
-	for _, templateV := range templates {
-		state.TemplatesMap[templateV.UUID] = templateV
+func (state *State) SetGroups(groups []types.NodeGroup) {
+	groups = slices.Clone(groups)
+	state.update(RESOURCE_GROUPS, func(next *Snapshot) { next.Groups = groups }, func(previous, current *Snapshot) (map[string]any, map[string]any) {
+		return keyed(previous.Groups, func(g types.NodeGroup) string { return g.Id }), keyed(current.Groups, func(g types.NodeGroup) string { return g.Id })
+	})
+}
+
+func (state *State) SetRegistryDisk(registryDisk types.RegistryDisk) {
+	state.update(RESOURCE_REGISTRY_DISK, func(next *Snapshot) { next.RegistryDisk = &registryDisk }, nil)
+}
+
+// SetTemplates replaces the templates with the current registry listing, so templates deleted from the registry are dropped.
+// It returns the UUIDs of the templates added and removed since the previous listing; both are empty for the first listing.
+func (state *State) SetTemplates(templates []types.Template) (added []string, removed []string) {
+	templatesMap := make(map[string]types.Template, len(templates))
+	for _, template := range templates {
+		templatesMap[template.UUID] = template
+	}
+	diff := state.update(RESOURCE_REGISTRY_TEMPLATES, func(next *Snapshot) { next.Templates = templatesMap }, func(previous, current *Snapshot) (map[string]any, map[string]any) {
+		return toAny(previous.Templates), toAny(current.Templates)
+	})
+	return diff.Added, diff.Removed
+}
+
+func (state *State) update(resource string, apply func(next *Snapshot), index func(previous, current *Snapshot) (map[string]any, map[string]any)) Diff {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+
+	previous := state.current.Load()
+	next := *previous
+	next.Version++
+	next.Time = time.Now()
+	next.updated = make(map[string]time.Time, len(previous.updated)+1)
+	for r, updated := range previous.updated {
+		next.updated[r] = updated
+	}
+	next.updated[resource] = next.Time
+	apply(&next)
+	state.current.Store(&next)
+
+	diff := Diff{Resource: resource, Previous: previous, Current: &next}
+	if index != nil && previous.Loaded(resource) {
+		before, after := index(previous, &next)
+		diff.Added, diff.Removed, diff.Updated = diffKeys(before, after)
+	}
+	for _, subscriber := range state.subscribers {
+		subscriber(diff)
+	}
+	return diff
+}
+
+func keyed[T any](items []T, key func(T) string) map[string]any {
+	m := make(map[string]any, len(items))
+	for _, item := range items {
+		m[key(item)] = item
+	}
+	return m
+}
+
+func toAny[T any](items map[string]T) map[string]any {
+	m := make(map[string]any, len(items))
+	for k, v := range items {
+		m[k] = v
+	}
+	return m
+}
+
+func diffKeys(before, after map[string]any) (added, removed, updated []string) {
+	for key, item := range after {
+		previous, ok := before[key]
+		if !ok {
+			added = append(added, key)
+		} else if !reflect.DeepEqual(previous, item) {
+			updated = append(updated, key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			removed = append(removed, key)
+		}
 	}
+	slices.Sort(added)
+	slices.Sort(removed)
+	slices.Sort(updated)
+	return added, removed, updated
 }
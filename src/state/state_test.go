@@ -0,0 +1,145 @@
+package state
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/veertuinc/anka-prometheus-exporter/src/types"
+)
+
+func instance(id, state string) types.Instance {
+	return types.Instance{InstanceID: id, Vm: types.VmData{State: state}}
+}
+
+func TestSubscribeDiffs(t *testing.T) {
+	tests := []struct {
+		name     string
+		update   func(state *State)
+		resource string
+		added    []string
+		removed  []string
+		updated  []string
+	}{
+		{
+			name: "first instances listing",
+			update: func(state *State) {
+				state.SetInstances([]types.Instance{instance("i1", "Started"), instance("i2", "Scheduling")})
+			},
+			resource: RESOURCE_INSTANCES,
+		},
+		{
+			name: "instances added, removed and updated",
+			update: func(state *State) {
+				state.SetInstances([]types.Instance{instance("i2", "Started"), instance("i3", "Pulling")})
+			},
+			resource: RESOURCE_INSTANCES,
+			added:    []string{"i3"},
+			removed:  []string{"i1"},
+			updated:  []string{"i2"},
+		},
+		{
+			name: "unchanged instances",
+			update: func(state *State) {
+				state.SetInstances([]types.Instance{instance("i3", "Pulling"), instance("i2", "Started")})
+			},
+			resource: RESOURCE_INSTANCES,
+		},
+		{
+			name:     "first nodes listing",
+			update:   func(state *State) { state.SetNodes([]types.Node{{NodeID: "n1", State: "Active"}}) },
+			resource: RESOURCE_NODES,
+		},
+		{
+			name:     "nodes updated",
+			update:   func(state *State) { state.SetNodes([]types.Node{{NodeID: "n1", State: "Offline"}, {NodeID: "n2"}}) },
+			resource: RESOURCE_NODES,
+			added:    []string{"n2"},
+			updated:  []string{"n1"},
+		},
+		{
+			name:     "first groups listing",
+			update:   func(state *State) { state.SetGroups([]types.NodeGroup{{Id: "g1"}, {Id: "g2"}}) },
+			resource: RESOURCE_GROUPS,
+		},
+		{
+			name:     "groups removed",
+			update:   func(state *State) { state.SetGroups([]types.NodeGroup{{Id: "g2"}}) },
+			resource: RESOURCE_GROUPS,
+			removed:  []string{"g1"},
+		},
+		{
+			name:     "first templates listing",
+			update:   func(state *State) { state.SetTemplates([]types.Template{{UUID: "t1"}, {UUID: "t2"}}) },
+			resource: RESOURCE_REGISTRY_TEMPLATES,
+		},
+		{
+			name:     "templates replaced",
+			update:   func(state *State) { state.SetTemplates([]types.Template{{UUID: "t2", Size: 10}, {UUID: "t3"}}) },
+			resource: RESOURCE_REGISTRY_TEMPLATES,
+			added:    []string{"t3"},
+			removed:  []string{"t1"},
+			updated:  []string{"t2"},
+		},
+		{
+			name:     "status",
+			update:   func(state *State) { state.SetStatus(types.Status{Status: "Running"}) },
+			resource: RESOURCE_STATUS,
+		},
+		{
+			name:     "registry disk",
+			update:   func(state *State) { state.SetRegistryDisk(types.RegistryDisk{Total: 10}) },
+			resource: RESOURCE_REGISTRY_DISK,
+		},
+	}
+	// the cases run in order against the same State: each one diffs against the listings of the previous ones
+	state := NewState()
+	diffs := []Diff{}
+	unsubscribe := state.Subscribe(func(diff Diff) { diffs = append(diffs, diff) })
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diffs = diffs[:0]
+			version := state.Snapshot().Version
+			test.update(state)
+			if len(diffs) != 1 {
+				t.Fatalf("%d diffs, expected 1", len(diffs))
+			}
+			diff := diffs[0]
+			if diff.Resource != test.resource {
+				t.Errorf("resource = %s, expected %s", diff.Resource, test.resource)
+			}
+			if diff.Previous.Version != version || diff.Current.Version != version+1 || diff.Current != state.Snapshot() {
+				t.Errorf("diff goes from version %d to %d, expected %d to the current %d", diff.Previous.Version, diff.Current.Version, version, version+1)
+			}
+			if !slices.Equal(diff.Added, test.added) {
+				t.Errorf("added = %v, expected %v", diff.Added, test.added)
+			}
+			if !slices.Equal(diff.Removed, test.removed) {
+				t.Errorf("removed = %v, expected %v", diff.Removed, test.removed)
+			}
+			if !slices.Equal(diff.Updated, test.updated) {
+				t.Errorf("updated = %v, expected %v", diff.Updated, test.updated)
+			}
+		})
+	}
+
+	unsubscribe()
+	diffs = diffs[:0]
+	state.SetStatus(types.Status{})
+	if len(diffs) != 0 {
+		t.Fatalf("%d diffs after unsubscribing, expected none", len(diffs))
+	}
+}
+
+func TestSetTemplatesReturnsChanges(t *testing.T) {
+	state := NewState()
+	if added, removed := state.SetTemplates([]types.Template{{UUID: "t1"}}); added != nil || removed != nil {
+		t.Fatalf("first listing returned added %v, removed %v; expected nothing", added, removed)
+	}
+	added, removed := state.SetTemplates([]types.Template{{UUID: "t2"}, {UUID: "t3"}})
+	if !slices.Equal(added, []string{"t2", "t3"}) || !slices.Equal(removed, []string{"t1"}) {
+		t.Fatalf("added %v, removed %v; expected [t2 t3], [t1]", added, removed)
+	}
+	if _, ok := state.Snapshot().Templates["t1"]; ok {
+		t.Fatal("the removed template is still in the snapshot")
+	}
+}
@@ -92,7 +92,6 @@ type VmData struct {
 type Response interface {
 	GetStatus() string
 	GetMessage() string
-	GetBody() interface{}
 }
 
 type DefaultResponse struct {
@@ -113,17 +112,14 @@ type StatusResponse struct {
 	Body Status `json:"body"`
 }
 
-func (sr *StatusResponse) GetBody() interface{} {
-	return sr.Body
-}
-
 type NodesResponse struct {
 	DefaultResponse
 	Body []Node `json:"body"`
 }
 
-func (nr *NodesResponse) GetBody() interface{} {
-	return nr.Body
+type GroupsResponse struct {
+	DefaultResponse
+	Body []NodeGroup `json:"body"`
 }
 
 type RegistryDiskResponse struct {
@@ -131,10 +127,6 @@ type RegistryDiskResponse struct {
 	Body RegistryDisk `json:"body"`
 }
 
-func (rdr *RegistryDiskResponse) GetBody() interface{} {
-	return rdr.Body
-}
-
 type Template struct {
 	UUID string `json:"id"`
 	Name string `json:"name"`
@@ -146,10 +138,6 @@ type RegistryTemplateResponse struct {
 	Body []Template `json:"body"`
 }
 
-func (rtr *RegistryTemplateResponse) GetBody() interface{} {
-	return rtr.Body
-}
-
 type TemplateTag struct {
 	Name string `json:"tag"`
 	Size uint   `json:"size"`
@@ -163,15 +151,7 @@ type RegistryTemplateTagsResponse struct {
 	Body RegistryTemplateTags `json:"body"`
 }
 
-func (rttr *RegistryTemplateTagsResponse) GetBody() interface{} {
-	return rttr.Body
-}
-
 type InstancesResponse struct {
 	DefaultResponse
 	Body []Instance `json:"body"`
 }
-
-func (ir *InstancesResponse) GetBody() interface{} {
-	return ir.Body
-}